@@ -0,0 +1,210 @@
+package forward
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+// maxBatchWrites is the limit of writes in one batch of Firestore.
+const maxBatchWrites = 500
+
+// RequestInfo is the state of the request document.
+type RequestInfo struct {
+	ID       string
+	Endpoint string
+	// RequestID is X-Request-Id of the request. It is same as ID for requests of old forwarders.
+	RequestID string
+	Created   time.Time
+	// Claimed is when the consumer started to process the request. Zero means not claimed.
+	Claimed time.Time
+	// Held is when the consumer started to hold the request. Zero means not held.
+	Held time.Time
+	// Responded is when the consumer wrote the response. Zero means not responded.
+	Responded time.Time
+	Request   *RequestPayload
+	// DecodeError is set when the request could not be decoded. e.g. encrypted without key.
+	DecodeError error
+}
+
+// NewRequestInfo extracts RequestInfo from the request document.
+func NewRequestInfo(doc *firestore.DocumentSnapshot, kr *Keyring) *RequestInfo {
+	info := &RequestInfo{
+		ID:        doc.Ref.ID,
+		Endpoint:  doc.Ref.Parent.Parent.ID,
+		RequestID: RequestIDOf(doc),
+	}
+	info.Created, _ = AsTime(doc.DataAt("created"))
+	info.Claimed, _ = AsTime(doc.DataAt("claimed"))
+	info.Held, _ = AsTime(doc.DataAt("held"))
+	info.Responded, _ = AsTime(doc.DataAt("response.time"))
+
+	req, err := DecodeRequest(doc, kr)
+	if err == nil {
+		err = req.Decompress()
+	}
+	info.Request, info.DecodeError = req, err
+	return info
+}
+
+// ListRequests returns the requests of the endpoint in order of creation.
+func ListRequests(ctx context.Context, client *firestore.Client, endpoint string, kr *Keyring) ([]*RequestInfo, error) {
+	it := client.Collection("endpoints").Doc(endpoint).Collection("requests").
+		OrderBy("created", firestore.Asc).Documents(ctx)
+	defer it.Stop()
+
+	var ret []*RequestInfo
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** requests it.Next")
+		}
+		ret = append(ret, NewRequestInfo(doc, kr))
+	}
+	return ret, nil
+}
+
+// DeleteRefs deletes the documents in batches.
+func DeleteRefs(ctx context.Context, client *firestore.Client, refs []*firestore.DocumentRef) error {
+	for len(refs) > 0 {
+		n := len(refs)
+		if n > maxBatchWrites {
+			n = maxBatchWrites
+		}
+		batch := client.Batch()
+		for _, e := range refs[:n] {
+			batch.Delete(e)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return errors.Wrapf(err, "*** batch.Commit")
+		}
+		refs = refs[n:]
+	}
+	return nil
+}
+
+// requestRefs returns the request document and its chunks.
+func requestRefs(ctx context.Context, ref *firestore.DocumentRef) ([]*firestore.DocumentRef, error) {
+	chunks, err := ref.Collection("responseBodies").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** responseBodies GetAll: %s", ref.ID)
+	}
+	return append(chunks, ref), nil
+}
+
+// DeleteRequest deletes the request document and its chunks.
+func DeleteRequest(ctx context.Context, client *firestore.Client, ref *firestore.DocumentRef) error {
+	refs, err := requestRefs(ctx, ref)
+	if err != nil {
+		return err
+	}
+	return DeleteRefs(ctx, client, refs)
+}
+
+// expiredRequests returns the request documents of the endpoint which are created before the time.
+// Only "created" and "response.time" are read, not the payloads.
+func expiredRequests(ctx context.Context, client *firestore.Client, endpoint string, before time.Time) ([]*firestore.DocumentSnapshot, error) {
+	docs, err := client.Collection("endpoints").Doc(endpoint).Collection("requests").
+		Where("created", "<", before).Select("created", "response.time").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** requests GetAll: %s", endpoint)
+	}
+	return docs, nil
+}
+
+// PurgeRequests deletes the requests of the endpoint which are created before the time, and their chunks.
+// It returns the number of deleted requests.
+func PurgeRequests(ctx context.Context, client *firestore.Client, endpoint string, before time.Time) (int, error) {
+	docs, err := expiredRequests(ctx, client, endpoint, before)
+	if err != nil {
+		return 0, err
+	}
+
+	var refs []*firestore.DocumentRef
+	for _, e := range docs {
+		r, err := requestRefs(ctx, e.Ref)
+		if err != nil {
+			return 0, err
+		}
+		refs = append(refs, r...)
+	}
+	if err := DeleteRefs(ctx, client, refs); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// EndpointNames returns names of all endpoints including the ones which are not registered.
+func EndpointNames(ctx context.Context, client *firestore.Client) ([]string, error) {
+	refs, err := client.Collection("endpoints").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** endpoints GetAll")
+	}
+	var ret []string
+	for _, e := range refs {
+		ret = append(ret, e.ID)
+	}
+	return ret, nil
+}
+
+// OrphanedChunks returns the chunks of responseBodies whose request document does not exist.
+func OrphanedChunks(ctx context.Context, client *firestore.Client) ([]*firestore.DocumentRef, error) {
+	// Only IDs are read, since chunks and requests are as large as 1MiB.
+	it := client.CollectionGroup("responseBodies").Select().Documents(ctx)
+	defer it.Stop()
+
+	byParent := map[string][]*firestore.DocumentRef{}
+	var parents []*firestore.DocumentRef
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** responseBodies it.Next")
+		}
+		parent := doc.Ref.Parent.Parent
+		if _, ok := byParent[parent.Path]; !ok {
+			parents = append(parents, parent)
+		}
+		byParent[parent.Path] = append(byParent[parent.Path], doc.Ref)
+	}
+
+	var ret []*firestore.DocumentRef
+	for _, e := range parents {
+		docs, err := e.Parent.Where(firestore.DocumentID, "==", e).Select().Documents(ctx).GetAll()
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** Get parent: %s", e.Path)
+		}
+		if len(docs) == 0 {
+			ret = append(ret, byParent[e.Path]...)
+		}
+	}
+	return ret, nil
+}
+
+// ExpiredQuotas returns quota/{yyyy-mm-dd} documents of the days before the day of t in UTC.
+func ExpiredQuotas(ctx context.Context, client *firestore.Client, t time.Time) ([]*firestore.DocumentRef, error) {
+	col := client.Collection("quota")
+	it := col.Where(firestore.DocumentID, "<", col.Doc(t.UTC().Format("2006-01-02"))).Select().Documents(ctx)
+	defer it.Stop()
+
+	var ret []*firestore.DocumentRef
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** quota it.Next")
+		}
+		ret = append(ret, doc.Ref)
+	}
+	return ret, nil
+}
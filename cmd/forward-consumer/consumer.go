@@ -9,9 +9,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -19,20 +17,60 @@ import (
 	"cloud.google.com/go/firestore"
 	"github.com/pkg/errors"
 	forward "github.com/tckz/personal-forward"
-	"go.opencensus.io/trace"
-	"go.opencensus.io/trace/propagation"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
 )
 
+// Exchange is the request and the response which are relayed by the consumer.
+type Exchange struct {
+	// Request is the request after OnRequest hook.
+	Request *HookRequest
+	// Response is the response after OnResponse hook. nil when forwarding failed.
+	Response *forward.ResponsePayload
+	Error    error
+	// Route describes how the request was handled. e.g. "^.* => http://localhost:3010", "hook"
+	Route string
+	Begin time.Time
+	// Wait is the duration until the response header arrived.
+	Wait time.Duration
+	// Receive is the duration to read the response body.
+	Receive time.Duration
+	// Replay is true when the request is re-sent from the record, not received from the forwarder.
+	Replay bool
+}
+
+// ExchangeRecorder receives every exchange relayed by the consumer.
+type ExchangeRecorder interface {
+	Record(ex *Exchange) error
+}
+
+type contextKeyReplayMarker struct{}
+
+var contextKeyReplay = &contextKeyReplayMarker{}
+
+// WithReplay marks the request in ctx as replayed.
+func WithReplay(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKeyReplay, true)
+}
+
+func isReplay(ctx context.Context) bool {
+	b, _ := ctx.Value(contextKeyReplay).(bool)
+	return b
+}
+
 type Consumer struct {
-	Propagation    propagation.HTTPFormat
 	Client         *http.Client
 	TargetPatterns []TargetPattern
 	MaxDumpBytes   uint64
-}
-
-type TargetPattern struct {
-	Pattern *regexp.Regexp
-	Target  *url.URL
+	Hook           Hook
+	// Keyring decrypts request and encrypts response when it is not nil.
+	Keyring *forward.Keyring
+	// Compress is the encoding to compress response body. Empty means no compression.
+	Compress         string
+	CompressMinBytes int
+	Recorders        []ExchangeRecorder
+	// Holder holds requests before forwarding when it is not nil and enabled.
+	Holder *Holder
 }
 
 func (c *Consumer) shouldDumpWithBody(header http.Header) bool {
@@ -43,10 +81,10 @@ func (c *Consumer) shouldDumpWithBody(header http.Header) bool {
 		(clText != "" && cle == nil && cl <= c.MaxDumpBytes)
 }
 
-func (c *Consumer) chooseTarget(path string) *url.URL {
-	for _, e := range c.TargetPatterns {
+func (c *Consumer) chooseTarget(path string) *TargetPattern {
+	for i, e := range c.TargetPatterns {
 		if e.Pattern.MatchString(path) {
-			return e.Target
+			return &c.TargetPatterns[i]
 		}
 	}
 
@@ -55,99 +93,76 @@ func (c *Consumer) chooseTarget(path string) *url.URL {
 
 func (c *Consumer) ForwardRequest(ctx context.Context, doc *firestore.DocumentSnapshot) (err error) {
 	defer func() {
+		// The request has been cancelled by the forwarder or timed out.
+		if err != nil && ctx.Err() != nil {
+			err = errors.Wrapf(err, "*** aborted: %v", ctx.Err())
+			return
+		}
 		if err != nil {
-			_, e2 := doc.Ref.Update(ctx, []firestore.Update{
-				{
-					Path:      "response",
-					FieldPath: nil,
-					Value: map[string]interface{}{
-						"time":  firestore.ServerTimestamp,
-						"error": err.Error(),
+			val, e2 := forward.EncodeResponse(doc.Ref.ID, &forward.ResponsePayload{Error: err.Error()}, c.Keyring)
+			if e2 == nil {
+				_, e2 = doc.Ref.Update(ctx, []firestore.Update{
+					{
+						Path:      "response",
+						FieldPath: nil,
+						Value:     val,
 					},
-				},
-			})
+				})
+			}
 			if e2 != nil {
+				metricFirestoreErrors.WithLabelValues("update").Inc()
 				err = errors.Wrapf(e2, "*** write error")
 			}
 		}
 	}()
 
-	method, _ := forward.AsString(doc.DataAt("request.httpInfo.method"))
-	requestURI, _ := forward.AsString(doc.DataAt("request.httpInfo.requestURI"))
-	header, _ := forward.AsHeader(doc.DataAt("request.header"))
-	body, _ := forward.AsByte(doc.DataAt("request.body"))
+	logger := requestLogger(ctx)
 
-	u, err := url.Parse(requestURI)
+	req, err := forward.DecodeRequest(doc, c.Keyring)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "*** DecodeRequest")
 	}
-
-	target := c.chooseTarget(u.Path)
-	if target == nil {
-		return fmt.Errorf("no target match for %s", u.Path)
+	if err := req.Decompress(); err != nil {
+		return errors.Wrapf(err, "*** Decompress request")
 	}
 
-	var span *trace.Span
-	if cx := header.Get(forward.CloudTraceContext); cx != "" {
-		req, _ := http.NewRequest("GET", "http://localhost/dummy", nil)
-		req.Header.Set(forward.CloudTraceContext, cx)
-		if sc, ok := c.Propagation.SpanContextFromRequest(req); ok {
-			ctx, span = trace.StartSpanWithRemoteParent(ctx, "ForwardRequest", sc)
-			defer span.End()
-		}
-	}
+	// Continue the trace of the forwarder.
+	ctx = forward.ExtractTraceContext(ctx, req.Header)
+	ctx, span := forward.Tracer().Start(ctx, "claim", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
 
-	u.Path = path.Join(target.Path, u.Path)
-	u.Host = target.Host
-	u.Scheme = target.Scheme
-
-	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
-	if err != nil {
-		return err
+	if created, err := forward.AsTime(doc.DataAt("created")); err == nil {
+		metricQueueDuration.Observe(time.Since(created).Seconds())
 	}
-	req = req.WithContext(ctx)
-	req.Header = header
 
-	if *optDumpForward {
-		if b, err := httputil.DumpRequestOut(req, c.shouldDumpWithBody(req.Header)); err == nil {
-			fmt.Fprintln(os.Stderr, string(b))
-		}
+	// Mark as claimed so that the state can be inspected by forwardctl.
+	if _, err := doc.Ref.Update(ctx, []firestore.Update{
+		{
+			Path:  "claimed",
+			Value: firestore.ServerTimestamp,
+		},
+	}); err != nil {
+		metricFirestoreErrors.WithLabelValues("update").Inc()
+		return errors.Wrapf(err, "*** doc.Ref.Update claimed: ID=%s", doc.Ref.ID)
 	}
 
-	begin := time.Now()
-	res, err := c.Client.Do(req)
+	hreq, res, err := c.hold(ctx, doc, &HookRequest{RequestPayload: *req})
 	if err != nil {
 		return err
 	}
-	defer func() {
-		io.Copy(ioutil.Discard, res.Body)
-		res.Body.Close()
-	}()
-
-	logger.Infof("url=%s, status=%d, dur=%s", req.URL.String(), res.StatusCode, time.Since(begin))
-
-	if *optDumpForward {
-		if b, err := httputil.DumpResponse(res, c.shouldDumpWithBody(res.Header)); err == nil {
-			fmt.Fprintln(os.Stderr, string(b))
+	if res == nil {
+		res, err = c.forward(ctx, hreq)
+		if err != nil {
+			return err
 		}
 	}
-
-	b, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return errors.Wrapf(err, "*** ioutil.ReadAll: response")
-	}
-
-	val := map[string]interface{}{
-		"time":       firestore.ServerTimestamp,
-		"statusCode": res.StatusCode,
-		"header":     res.Header,
-		"chunks":     0,
+	if err := res.Compress(c.Compress, c.CompressMinBytes); err != nil {
+		return errors.Wrapf(err, "*** Compress response")
 	}
+	b := res.Body
 
 	var chunks [][]byte
-	if uint(len(b)) <= *optChunkBytes {
-		val["body"] = b
-	} else {
+	if uint(len(b)) > *optChunkBytes {
 		// split body to chunks
 		sliceSize := uint(len(b))
 		chunkSize := *optChunkBytes
@@ -160,10 +175,16 @@ func (c *Consumer) ForwardRequest(ctx context.Context, doc *firestore.DocumentSn
 			chunks = append(chunks, b[i:end])
 		}
 
-		val["chunks"] = len(chunks)
+		res.Chunks = len(chunks)
 	}
+	metricResponseChunks.Observe(float64(len(chunks)))
 
-	logger.Infof("responseSize=%d, chunks=%d", len(b), len(chunks))
+	logger.Infof("responseSize=%d, encoding=%s, chunks=%d", len(b), res.Encoding, len(chunks))
+
+	val, err := forward.EncodeResponse(doc.Ref.ID, res, c.Keyring)
+	if err != nil {
+		return errors.Wrapf(err, "*** EncodeResponse")
+	}
 
 	_, err = doc.Ref.Update(ctx, []firestore.Update{
 		{
@@ -173,6 +194,7 @@ func (c *Consumer) ForwardRequest(ctx context.Context, doc *firestore.DocumentSn
 		},
 	})
 	if err != nil {
+		metricFirestoreErrors.WithLabelValues("update").Inc()
 		return errors.Wrapf(err, "*** doc.Ref.Update response: ID=%s", doc.Ref.ID)
 	}
 
@@ -180,12 +202,13 @@ func (c *Consumer) ForwardRequest(ctx context.Context, doc *firestore.DocumentSn
 	if len(chunks) > 0 {
 		col := doc.Ref.Collection("responseBodies")
 		for i, e := range chunks {
-			ref, _, err := col.Add(ctx, map[string]interface{}{
-				"index": i,
-				"chunk": e,
-				"size":  len(e),
-			})
+			val, err := forward.EncodeChunk(doc.Ref.ID, i, e, c.Keyring)
+			if err != nil {
+				return errors.Wrapf(err, "*** EncodeChunk: index=%d", i)
+			}
+			ref, _, err := col.Add(ctx, val)
 			if err != nil {
+				metricFirestoreErrors.WithLabelValues("chunk").Inc()
 				return errors.Wrapf(err, "*** Add chunk of response: index=%d", i)
 			}
 			logger.Infof("Chunk[%d/%d]: Path=%s, size=%d", i+1, len(chunks), ref.Path, len(e))
@@ -194,3 +217,220 @@ func (c *Consumer) ForwardRequest(ctx context.Context, doc *firestore.DocumentSn
 
 	return nil
 }
+
+// hold waits for the decision when holding is enabled.
+// It returns the request to forward, or the response when the request is rejected.
+func (c *Consumer) hold(ctx context.Context, doc *firestore.DocumentSnapshot, hreq *HookRequest) (*HookRequest, *forward.ResponsePayload, error) {
+	if c.Holder == nil || !c.Holder.Enabled.Enabled() {
+		return hreq, nil, nil
+	}
+
+	// Mark as held so that forwardctl can find the request to decide.
+	if _, err := doc.Ref.Update(ctx, []firestore.Update{
+		{
+			Path:  "held",
+			Value: firestore.ServerTimestamp,
+		},
+	}); err != nil {
+		metricFirestoreErrors.WithLabelValues("update").Inc()
+		return nil, nil, errors.Wrapf(err, "*** doc.Ref.Update held: ID=%s", doc.Ref.ID)
+	}
+
+	d, err := c.Holder.Hold(ctx, doc.Ref.ID, hreq)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "*** Hold: ID=%s", doc.Ref.ID)
+	}
+	switch d.Action {
+	case forward.HoldActionReject:
+		return nil, RejectResponse(d), nil
+	case forward.HoldActionRelease:
+		if d.Request != nil {
+			if err := d.Request.Decompress(); err != nil {
+				return nil, nil, errors.Wrapf(err, "*** Decompress released request")
+			}
+			hreq = &HookRequest{RequestPayload: *d.Request}
+		}
+		return hreq, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown action of decision: %s", d.Action)
+}
+
+// forward sends the request to the target and returns its response.
+// The hook is applied before and after forwarding.
+func (c *Consumer) forward(ctx context.Context, hreq *HookRequest) (ret *forward.ResponsePayload, err error) {
+	logger := requestLogger(ctx)
+	ex := &Exchange{
+		Request: hreq,
+		Begin:   time.Now(),
+		Replay:  isReplay(ctx),
+	}
+	if len(c.Recorders) > 0 {
+		defer func() {
+			ex.Response, ex.Error = ret, err
+			for _, r := range c.Recorders {
+				if err := r.Record(ex); err != nil {
+					logger.Errorf("*** Record: %v", err)
+				}
+			}
+		}()
+	}
+
+	if c.Hook != nil {
+		res, err := c.Hook.OnRequest(ctx, hreq)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** Hook.OnRequest")
+		}
+		if res != nil {
+			logger.Infof("uri=%s, status=%d, responded by hook", hreq.RequestURI, res.StatusCode)
+			metricRequests.WithLabelValues("hook", strconv.Itoa(res.StatusCode)).Inc()
+			ex.Route = "hook"
+			return res, nil
+		}
+	}
+
+	u, err := url.Parse(hreq.RequestURI)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *TargetPattern
+	if hreq.Target != "" {
+		tp, err := NewTargetPattern("**", hreq.Target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** target from hook")
+		}
+		target = &tp
+	} else {
+		target = c.chooseTarget(u.Path)
+	}
+	if target == nil {
+		return nil, fmt.Errorf("no target match for %s", u.Path)
+	}
+	ex.Route = target.String()
+
+	if target.Handler == nil {
+		u.Path = path.Join(target.Target.Path, u.Path)
+		u.Host = target.Target.Host
+		u.Scheme = target.Target.Scheme
+	}
+
+	req, err := http.NewRequest(hreq.Method, u.String(), bytes.NewReader(hreq.Body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = hreq.Header
+	if id := forward.ExtractRequestID(ctx); id != "" && req.Header.Get(forward.RequestIDHeader) == "" {
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		req.Header.Set(forward.RequestIDHeader, id)
+	}
+
+	if optDumpForward.Enabled() {
+		dump := httputil.DumpRequestOut
+		if target.Handler != nil {
+			dump = httputil.DumpRequest
+		}
+		if b, err := dump(req, c.shouldDumpWithBody(req.Header)); err == nil {
+			writeDump(ctx, b)
+		}
+	}
+
+	label := targetLabel(target.Target)
+	begin := time.Now()
+	var res *http.Response
+	if target.Handler != nil {
+		req.Host = hreq.Header.Get("host")
+		req.RequestURI = hreq.RequestURI
+		_, span := forward.Tracer().Start(ctx, "serve "+label)
+		res = target.ServeInProcess(req)
+		span.End()
+	} else {
+		res, err = c.Client.Do(req)
+		if err != nil {
+			metricRequests.WithLabelValues(label, "error").Inc()
+			return nil, err
+		}
+	}
+	ex.Wait = time.Since(begin)
+	metricUpstreamDuration.WithLabelValues(label).Observe(ex.Wait.Seconds())
+	metricRequests.WithLabelValues(label, strconv.Itoa(res.StatusCode)).Inc()
+	defer func() {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	logger.Infof("url=%s, target=%s, status=%d, dur=%s", req.URL.String(), target.Target, res.StatusCode, time.Since(begin))
+
+	if optDumpForward.Enabled() {
+		if b, err := httputil.DumpResponse(res, c.shouldDumpWithBody(res.Header)); err == nil {
+			writeDump(ctx, b)
+		}
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** ioutil.ReadAll: response")
+	}
+	ex.Receive = time.Since(begin) - ex.Wait
+
+	ret = &forward.ResponsePayload{
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       b,
+	}
+
+	if c.Hook != nil {
+		if err := c.Hook.OnResponse(ctx, hreq, ret); err != nil {
+			return nil, errors.Wrapf(err, "*** Hook.OnResponse")
+		}
+	}
+	fixResponseHeader(req.Method, ret)
+
+	return ret, nil
+}
+
+// requestLogger returns the logger with the request ID of ctx.
+func requestLogger(ctx context.Context) *zap.SugaredLogger {
+	if id := forward.ExtractRequestID(ctx); id != "" {
+		return logger.With(zap.String("requestId", id))
+	}
+	return logger
+}
+
+// writeDump writes the dump to dumpOutput with the request ID of ctx.
+func writeDump(ctx context.Context, b []byte) {
+	if id := forward.ExtractRequestID(ctx); id != "" {
+		fmt.Fprintf(dumpOutput, "# requestId=%s\n%s\n", id, b)
+		return
+	}
+	fmt.Fprintln(dumpOutput, string(b))
+}
+
+// hopByHopHeaders are meaningful only for a single connection, so they are not relayed. RFC 7230 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// fixResponseHeader makes the header consistent with the body which is relayed as a whole.
+// Content-Encoding of the upstream is kept and Content-Length is the length of the encoded body.
+func fixResponseHeader(method string, res *forward.ResponsePayload) {
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	for _, e := range hopByHopHeaders {
+		res.Header.Del(e)
+	}
+	// Content-Length of HEAD, 204 and 304 describes the representation, not the body.
+	if method == http.MethodHead || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return
+	}
+	res.Header.Set("Content-Length", strconv.Itoa(len(res.Body)))
+}
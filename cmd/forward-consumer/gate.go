@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Gate blocks workers while it is paused.
+type Gate struct {
+	mu sync.Mutex
+	// paused is closed on Resume. nil means not paused.
+	paused chan struct{}
+}
+
+func (g *Gate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused == nil {
+		g.paused = make(chan struct{})
+	}
+}
+
+func (g *Gate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused != nil {
+		close(g.paused)
+		g.paused = nil
+	}
+}
+
+func (g *Gate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused != nil
+}
+
+// Toggle pauses or resumes and returns true when it is paused.
+func (g *Gate) Toggle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused != nil {
+		close(g.paused)
+		g.paused = nil
+		return false
+	}
+	g.paused = make(chan struct{})
+	return true
+}
+
+// Wait blocks until the gate is resumed or ctx is done.
+func (g *Gate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	paused := g.paused
+	g.mu.Unlock()
+	if paused == nil {
+		return nil
+	}
+	select {
+	case <-paused:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
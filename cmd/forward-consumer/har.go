@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HAR 1.2 http://www.softwareishard.com/blog/har-12-spec/
+// Fields starting with "_" are custom fields.
+
+type HARLog struct {
+	Log HARBody `json:"log"`
+}
+
+type HARBody struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+	Route           string      `json:"_route,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+	Replay          bool        `json:"_replay,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// HAR 1.2 has no encoding for postData.
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	ret := []HARNameValue{}
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			ret = append(ret, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return ret
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// requestURL returns the URL which the original client requested.
+func requestURL(req *HookRequest) string {
+	scheme := "http"
+	if req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	host := req.Header.Get("Host")
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, req.RequestURI)
+}
+
+// NewHAREntry converts the exchange to the entry of HAR.
+// Bodies are not truncated and always base64 encoded.
+func NewHAREntry(ex *Exchange) HAREntry {
+	req := ex.Request
+	entry := HAREntry{
+		StartedDateTime: ex.Begin,
+		Time:            millis(ex.Wait + ex.Receive),
+		Route:           ex.Route,
+		Replay:          ex.Replay,
+		Request: HARRequest{
+			Method:      req.Method,
+			URL:         requestURL(req),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(req.Body),
+		},
+		Response: HARResponse{
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     []HARNameValue{},
+			HeadersSize: -1,
+		},
+		Timings: HARTimings{
+			Wait:    millis(ex.Wait),
+			Receive: millis(ex.Receive),
+		},
+	}
+
+	if u, err := url.Parse(req.RequestURI); err == nil {
+		for k, values := range u.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{Name: k, Value: v})
+			}
+		}
+	}
+
+	if len(req.Body) > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     base64.StdEncoding.EncodeToString(req.Body),
+			Encoding: "base64",
+		}
+	}
+
+	if ex.Error != nil {
+		entry.Error = ex.Error.Error()
+	}
+	if res := ex.Response; res != nil {
+		entry.Response.Status = res.StatusCode
+		entry.Response.StatusText = http.StatusText(res.StatusCode)
+		entry.Response.Headers = harHeaders(res.Header)
+		entry.Response.BodySize = len(res.Body)
+		entry.Response.Content = HARContent{
+			Size:     len(res.Body),
+			MimeType: res.Header.Get("Content-Type"),
+			Text:     base64.StdEncoding.EncodeToString(res.Body),
+			Encoding: "base64",
+		}
+	}
+	return entry
+}
+
+// harTrailer closes entries and the log.
+var harTrailer = []byte("]}}\n")
+
+// HARRecorder writes exchanges to HAR files in the directory.
+// The file is kept valid after each entry by overwriting the trailer, and rotated by number of entries.
+type HARRecorder struct {
+	Dir string
+	// MaxEntries is the number of entries per file.
+	MaxEntries int
+
+	mu      sync.Mutex
+	file    *os.File
+	entries int
+	seq     int
+	session string
+}
+
+// NewHARRecorder creates HARRecorder. The directory is created when it does not exist.
+func NewHARRecorder(dir string, maxEntries int) (*HARRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "*** MkdirAll: %s", dir)
+	}
+	return &HARRecorder{
+		Dir:        dir,
+		MaxEntries: maxEntries,
+		session:    time.Now().Format("20060102T150405"),
+	}, nil
+}
+
+func (r *HARRecorder) open() error {
+	r.seq++
+	name := filepath.Join(r.Dir, fmt.Sprintf("%s-%s-%04d.har", myName, r.session, r.seq))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "*** OpenFile: %s", name)
+	}
+
+	head, err := json.Marshal(HARLog{
+		Log: HARBody{
+			Version: "1.2",
+			Creator: HARCreator{Name: myName, Version: version},
+			Entries: []HAREntry{},
+		},
+	})
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "*** json.Marshal")
+	}
+	// Split `..."entries":[]}}` into the head and the trailer.
+	head = head[:len(head)-len(harTrailer)+1]
+	if _, err := f.Write(append(head, harTrailer...)); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "*** Write: %s", name)
+	}
+
+	r.file = f
+	r.entries = 0
+	logger.Infof("Recording to %s", name)
+	return nil
+}
+
+// Record appends the exchange to the current file.
+func (r *HARRecorder) Record(ex *Exchange) error {
+	b, err := json.Marshal(NewHAREntry(ex))
+	if err != nil {
+		return errors.Wrapf(err, "*** json.Marshal")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil && r.MaxEntries > 0 && r.entries >= r.MaxEntries {
+		r.file.Close()
+		r.file = nil
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.file.Seek(-int64(len(harTrailer)), io.SeekEnd); err != nil {
+		return errors.Wrapf(err, "*** Seek")
+	}
+	if r.entries > 0 {
+		b = append([]byte(","), b...)
+	}
+	if _, err := r.file.Write(append(b, harTrailer...)); err != nil {
+		return errors.Wrapf(err, "*** Write")
+	}
+	r.entries++
+	return nil
+}
+
+// Close closes the current file.
+func (r *HARRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	forward "github.com/tckz/personal-forward"
+)
+
+// HeldRequest is the request which waits for the decision.
+type HeldRequest struct {
+	ID      string
+	Request *HookRequest
+	Since   time.Time
+	// Deadline is when the request is given up. Zero means no deadline.
+	Deadline time.Time
+
+	decision chan *forward.HoldDecision
+}
+
+// Holder keeps claimed requests pending until they are released or rejected, like a breakpoint.
+type Holder struct {
+	// Enabled holds new requests while it is true. Requests already held are not affected.
+	Enabled forward.SwitchFlag
+
+	mu   sync.Mutex
+	held map[string]*HeldRequest
+}
+
+func NewHolder() *Holder {
+	return &Holder{
+		held: map[string]*HeldRequest{},
+	}
+}
+
+// Hold blocks until the decision for the request is made or ctx is done.
+func (h *Holder) Hold(ctx context.Context, id string, req *HookRequest) (*forward.HoldDecision, error) {
+	hr := &HeldRequest{
+		ID:       id,
+		Request:  req,
+		Since:    time.Now(),
+		decision: make(chan *forward.HoldDecision, 1),
+	}
+	hr.Deadline, _ = ctx.Deadline()
+
+	h.mu.Lock()
+	h.held[id] = hr
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.held, id)
+		h.mu.Unlock()
+	}()
+
+	logger := requestLogger(ctx)
+	logger.Infof("Hold request: id=%s, method=%s, uri=%s", id, req.Method, req.RequestURI)
+	select {
+	case d := <-hr.decision:
+		logger.Infof("Decided held request: id=%s, action=%s", id, d.Action)
+		return d, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Decide passes the decision to the held request. It returns false when the request is not held.
+func (h *Holder) Decide(id string, d *forward.HoldDecision) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hr, ok := h.held[id]
+	if !ok {
+		return false
+	}
+	delete(h.held, id)
+	hr.decision <- d
+	return true
+}
+
+// ReleaseAll releases all held requests as they are.
+func (h *Holder) ReleaseAll() int {
+	n := 0
+	for _, e := range h.List() {
+		if h.Decide(e.ID, &forward.HoldDecision{Action: forward.HoldActionRelease}) {
+			n++
+		}
+	}
+	return n
+}
+
+// Get returns the held request. nil when it is not held.
+func (h *Holder) Get(id string) *HeldRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.held[id]
+}
+
+// List returns held requests in order of holding.
+func (h *Holder) List() []*HeldRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ret := make([]*HeldRequest, 0, len(h.held))
+	for _, e := range h.held {
+		ret = append(ret, e)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Since.Before(ret[j].Since) })
+	return ret
+}
+
+// RejectResponse is the response for the rejected request.
+func RejectResponse(d *forward.HoldDecision) *forward.ResponsePayload {
+	code := d.StatusCode
+	if code == 0 {
+		code = http.StatusServiceUnavailable
+	}
+	msg := d.Message
+	if msg == "" {
+		msg = "rejected by forward-consumer"
+	}
+	return &forward.ResponsePayload{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       []byte(msg + "\n"),
+	}
+}
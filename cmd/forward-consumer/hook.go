@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Hook inspects and modifies the request before forwarding and the response before it is written back.
+type Hook interface {
+	// OnRequest can modify req.
+	// When it returns non-nil response, forwarding is skipped and the response is written back.
+	OnRequest(ctx context.Context, req *HookRequest) (*forward.ResponsePayload, error)
+	// OnResponse can modify res.
+	OnResponse(ctx context.Context, req *HookRequest, res *forward.ResponsePayload) error
+}
+
+type HookRequest struct {
+	forward.RequestPayload
+	// Target overrides the target chosen by patterns when it is not empty.
+	Target string
+}
+
+// LuaHook runs Lua script as Hook.
+//
+// The script can define global functions below. Both are optional.
+//
+//	function on_request(req)
+//	  -- req.method, req.uri, req.header, req.body, req.target can be modified.
+//	  -- Return {status=..., header=..., body=...} to respond without forwarding.
+//	end
+//	function on_response(req, res)
+//	  -- res.status, res.header, res.body can be modified.
+//	end
+//
+// header is a table of name to array of values.
+// Functions forward.hmac_sha256(key, data), forward.sha256(data), forward.base64(data) and forward.log(msg) are available.
+//
+// Each worker runs the script in its own LState, so that global variables are not shared among workers.
+type LuaHook struct {
+	// pool holds LStates which are not in use, since LState is not goroutine safe.
+	pool chan *lua.LState
+	all  []*lua.LState
+}
+
+// NewLuaHook compiles the script file and creates size of LStates which run it.
+func NewLuaHook(file string, size int) (*LuaHook, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Open: %s", file)
+	}
+	defer f.Close()
+
+	chunk, err := parse.Parse(bufio.NewReader(f), file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Parse: %s", file)
+	}
+	proto, err := lua.Compile(chunk, file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Compile: %s", file)
+	}
+
+	if size < 1 {
+		size = 1
+	}
+	h := &LuaHook{pool: make(chan *lua.LState, size)}
+	for i := 0; i < size; i++ {
+		ls, err := newLuaState(proto)
+		if err != nil {
+			h.Close()
+			return nil, errors.Wrapf(err, "*** Run: %s", file)
+		}
+		h.all = append(h.all, ls)
+		h.pool <- ls
+	}
+	return h, nil
+}
+
+func newLuaState(proto *lua.FunctionProto) (*lua.LState, error) {
+	ls := lua.NewState()
+
+	mod := ls.NewTable()
+	ls.SetFuncs(mod, map[string]lua.LGFunction{
+		"hmac_sha256": func(ls *lua.LState) int {
+			mac := hmac.New(sha256.New, []byte(ls.CheckString(1)))
+			mac.Write([]byte(ls.CheckString(2)))
+			ls.Push(lua.LString(hex.EncodeToString(mac.Sum(nil))))
+			return 1
+		},
+		"sha256": func(ls *lua.LState) int {
+			sum := sha256.Sum256([]byte(ls.CheckString(1)))
+			ls.Push(lua.LString(hex.EncodeToString(sum[:])))
+			return 1
+		},
+		"base64": func(ls *lua.LState) int {
+			ls.Push(lua.LString(base64.StdEncoding.EncodeToString([]byte(ls.CheckString(1)))))
+			return 1
+		},
+		"log": func(ls *lua.LState) int {
+			logger.Infof("lua: %s", ls.CheckString(1))
+			return 0
+		},
+	})
+	ls.SetGlobal("forward", mod)
+
+	ls.Push(ls.NewFunctionFromProto(proto))
+	if err := ls.PCall(0, lua.MultRet, nil); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	return ls, nil
+}
+
+func (h *LuaHook) Close() {
+	for _, e := range h.all {
+		e.Close()
+	}
+}
+
+func (h *LuaHook) OnRequest(ctx context.Context, req *HookRequest) (*forward.ResponsePayload, error) {
+	ls := <-h.pool
+	defer func() {
+		h.pool <- ls
+	}()
+
+	fn := ls.GetGlobal("on_request")
+	if fn == lua.LNil {
+		return nil, nil
+	}
+
+	ls.SetContext(ctx)
+	defer ls.RemoveContext()
+
+	treq := requestToTable(ls, req)
+	if err := ls.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, treq); err != nil {
+		return nil, err
+	}
+	ret := ls.Get(-1)
+	ls.Pop(1)
+
+	tableToRequest(treq, req)
+
+	if tres, ok := ret.(*lua.LTable); ok {
+		res := &forward.ResponsePayload{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+		}
+		tableToResponse(tres, res)
+		return res, nil
+	}
+
+	return nil, nil
+}
+
+func (h *LuaHook) OnResponse(ctx context.Context, req *HookRequest, res *forward.ResponsePayload) error {
+	ls := <-h.pool
+	defer func() {
+		h.pool <- ls
+	}()
+
+	fn := ls.GetGlobal("on_response")
+	if fn == lua.LNil {
+		return nil
+	}
+
+	ls.SetContext(ctx)
+	defer ls.RemoveContext()
+
+	tres := responseToTable(ls, res)
+	if err := ls.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, requestToTable(ls, req), tres); err != nil {
+		return err
+	}
+	ret := ls.Get(-1)
+	ls.Pop(1)
+
+	if t, ok := ret.(*lua.LTable); ok {
+		tres = t
+	}
+	tableToResponse(tres, res)
+
+	return nil
+}
+
+func requestToTable(ls *lua.LState, req *HookRequest) *lua.LTable {
+	t := ls.NewTable()
+	t.RawSetString("method", lua.LString(req.Method))
+	t.RawSetString("uri", lua.LString(req.RequestURI))
+	t.RawSetString("header", headerToTable(ls, req.Header))
+	t.RawSetString("body", lua.LString(req.Body))
+	t.RawSetString("target", lua.LString(req.Target))
+	return t
+}
+
+func tableToRequest(t *lua.LTable, req *HookRequest) {
+	req.Method = lua.LVAsString(t.RawGetString("method"))
+	req.RequestURI = lua.LVAsString(t.RawGetString("uri"))
+	req.Header = tableToHeader(t.RawGetString("header"))
+	req.Body = []byte(lua.LVAsString(t.RawGetString("body")))
+	req.Target = lua.LVAsString(t.RawGetString("target"))
+}
+
+func responseToTable(ls *lua.LState, res *forward.ResponsePayload) *lua.LTable {
+	t := ls.NewTable()
+	t.RawSetString("status", lua.LNumber(res.StatusCode))
+	t.RawSetString("header", headerToTable(ls, res.Header))
+	t.RawSetString("body", lua.LString(res.Body))
+	return t
+}
+
+func tableToResponse(t *lua.LTable, res *forward.ResponsePayload) {
+	if v, ok := t.RawGetString("status").(lua.LNumber); ok {
+		res.StatusCode = int(v)
+	}
+	if v := t.RawGetString("header"); v != lua.LNil {
+		res.Header = tableToHeader(v)
+	}
+	res.Body = []byte(lua.LVAsString(t.RawGetString("body")))
+}
+
+func headerToTable(ls *lua.LState, header http.Header) *lua.LTable {
+	t := ls.NewTable()
+	for k, values := range header {
+		vt := ls.NewTable()
+		for _, e := range values {
+			vt.Append(lua.LString(e))
+		}
+		t.RawSetString(k, vt)
+	}
+	return t
+}
+
+// tableToHeader converts lua table to http.Header.
+// Both of array of string and string are accepted as the value.
+func tableToHeader(v lua.LValue) http.Header {
+	header := make(http.Header)
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return header
+	}
+
+	t.ForEach(func(k, v lua.LValue) {
+		name := lua.LVAsString(k)
+		switch vv := v.(type) {
+		case *lua.LTable:
+			vv.ForEach(func(_, e lua.LValue) {
+				header.Add(name, lua.LVAsString(e))
+			})
+		case lua.LString, lua.LNumber:
+			header.Add(name, lua.LVAsString(vv))
+		}
+	})
+	return header
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Inflight tracks requests which are queued or being forwarded,
+// so that they can be aborted when the forwarder cancels them.
+type Inflight struct {
+	mu sync.Mutex
+	// cancels holds cancel func of the request being forwarded. nil means queued.
+	cancels   map[string]context.CancelFunc
+	cancelled map[string]bool
+}
+
+func NewInflight() *Inflight {
+	return &Inflight{
+		cancels:   map[string]context.CancelFunc{},
+		cancelled: map[string]bool{},
+	}
+}
+
+// Queue registers the request which is going to be forwarded.
+func (f *Inflight) Queue(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels[id] = nil
+}
+
+// Start returns ctx which is cancelled by Cancel.
+// It returns false when the request has been cancelled while it is queued.
+// Done must be called after forwarding.
+func (f *Inflight) Start(ctx context.Context, id string) (context.Context, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cancelled[id] {
+		return ctx, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f.cancels[id] = cancel
+	return ctx, true
+}
+
+// Done releases the request.
+func (f *Inflight) Done(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cancel := f.cancels[id]; cancel != nil {
+		cancel()
+	}
+	delete(f.cancels, id)
+	delete(f.cancelled, id)
+}
+
+// Cancel aborts the request. It returns false when the request is not tracked.
+func (f *Inflight) Cancel(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cancel, ok := f.cancels[id]
+	if !ok {
+		return false
+	}
+	if cancel != nil {
+		cancel()
+	} else {
+		f.cancelled[id] = true
+	}
+	return true
+}
+
+// Counts returns the number of queued requests and requests being forwarded.
+func (f *Inflight) Counts() (queued int, active int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, cancel := range f.cancels {
+		if cancel == nil {
+			queued++
+		} else {
+			active++
+		}
+	}
+	return queued, active
+}
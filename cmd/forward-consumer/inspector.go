@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	forward "github.com/tckz/personal-forward"
+)
+
+// InspectedExchange is the exchange kept by Inspector.
+type InspectedExchange struct {
+	ID int64
+	*Exchange
+}
+
+// Inspector keeps recent exchanges in memory and serves web UI to inspect and replay them.
+type Inspector struct {
+	Consumer *Consumer
+	// MaxEntries is the number of exchanges kept. Older ones are dropped.
+	MaxEntries int
+	// Timeout is the timeout of the replayed request.
+	Timeout time.Duration
+	// Holder is controlled from web UI when it is not nil.
+	Holder *Holder
+	// AnyHost accepts requests whose Host is not loopback. e.g. web UI is bound to non-loopback address.
+	AnyHost bool
+
+	mu          sync.Mutex
+	seq         int64
+	entries     []*InspectedExchange
+	subscribers map[chan *InspectedExchange]struct{}
+}
+
+func NewInspector(consumer *Consumer, maxEntries int, timeout time.Duration) *Inspector {
+	return &Inspector{
+		Consumer:    consumer,
+		MaxEntries:  maxEntries,
+		Timeout:     timeout,
+		subscribers: map[chan *InspectedExchange]struct{}{},
+	}
+}
+
+// Record adds the exchange and notifies it to the subscribers.
+func (in *Inspector) Record(ex *Exchange) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.seq++
+	e := &InspectedExchange{ID: in.seq, Exchange: ex}
+	in.entries = append(in.entries, e)
+	if in.MaxEntries > 0 && len(in.entries) > in.MaxEntries {
+		in.entries = in.entries[len(in.entries)-in.MaxEntries:]
+	}
+
+	for ch := range in.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// The subscriber is too slow. It can reload the list.
+		}
+	}
+	return nil
+}
+
+func (in *Inspector) find(id int64) *InspectedExchange {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, e := range in.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (in *Inspector) subscribe() chan *InspectedExchange {
+	ch := make(chan *InspectedExchange, 64)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (in *Inspector) unsubscribe(ch chan *InspectedExchange) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	delete(in.subscribers, ch)
+}
+
+// ExchangeSummary is the row of the list.
+type ExchangeSummary struct {
+	ID           int64     `json:"id"`
+	Begin        time.Time `json:"begin"`
+	Method       string    `json:"method"`
+	URI          string    `json:"uri"`
+	Host         string    `json:"host"`
+	Route        string    `json:"route"`
+	Status       int       `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	Millis       float64   `json:"millis"`
+	RequestSize  int       `json:"requestSize"`
+	ResponseSize int       `json:"responseSize"`
+	Replay       bool      `json:"replay"`
+}
+
+// ExchangeDetail is the exchange with headers and bodies.
+type ExchangeDetail struct {
+	ExchangeSummary
+	RequestHeader  http.Header    `json:"requestHeader"`
+	RequestBody    *InspectedBody `json:"requestBody"`
+	ResponseHeader http.Header    `json:"responseHeader"`
+	ResponseBody   *InspectedBody `json:"responseBody"`
+}
+
+// InspectedBody is the body which is formatted for display.
+type InspectedBody struct {
+	Size        int    `json:"size"`
+	ContentType string `json:"contentType"`
+	// Kind is one of "json", "form", "multipart", "text", "binary" and "empty".
+	Kind string `json:"kind"`
+	// Text is the formatted body. Empty when the body is binary.
+	Text string `json:"text"`
+	// Raw is the body which is not formatted. Empty when the body is not valid UTF-8.
+	Raw    string          `json:"raw"`
+	Form   []HARNameValue  `json:"form,omitempty"`
+	Parts  []InspectedPart `json:"parts,omitempty"`
+	Base64 string          `json:"base64"`
+	Note   string          `json:"note,omitempty"`
+}
+
+type InspectedPart struct {
+	Header http.Header    `json:"header"`
+	Body   *InspectedBody `json:"body"`
+}
+
+func (e *InspectedExchange) Summary() ExchangeSummary {
+	req := e.Request
+	s := ExchangeSummary{
+		ID:          e.ID,
+		Begin:       e.Begin,
+		Method:      req.Method,
+		URI:         req.RequestURI,
+		Host:        req.Header.Get("Host"),
+		Route:       e.Route,
+		Millis:      millis(e.Wait + e.Receive),
+		RequestSize: len(req.Body),
+		Replay:      e.Replay,
+	}
+	if e.Error != nil {
+		s.Error = e.Error.Error()
+	}
+	if res := e.Response; res != nil {
+		s.Status = res.StatusCode
+		s.ResponseSize = len(res.Body)
+	}
+	return s
+}
+
+func (e *InspectedExchange) Detail() ExchangeDetail {
+	d := ExchangeDetail{
+		ExchangeSummary: e.Summary(),
+		RequestHeader:   e.Request.Header,
+		RequestBody:     NewInspectedBody(e.Request.Header, e.Request.Body),
+		ResponseHeader:  http.Header{},
+	}
+	if res := e.Response; res != nil {
+		d.ResponseHeader = res.Header
+		d.ResponseBody = NewInspectedBody(res.Header, res.Body)
+	}
+	return d
+}
+
+// NewInspectedBody formats the body according to Content-Encoding and Content-Type of the header.
+func NewInspectedBody(header http.Header, body []byte) *InspectedBody {
+	ret := &InspectedBody{
+		Size:        len(body),
+		ContentType: header.Get("Content-Type"),
+		Base64:      base64.StdEncoding.EncodeToString(body),
+	}
+	if len(body) == 0 {
+		ret.Kind = "empty"
+		return ret
+	}
+
+	if ce := header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		b, err := forward.Decompress(ce, body)
+		if err != nil {
+			ret.Kind = "binary"
+			ret.Note = fmt.Sprintf("Content-Encoding %s can not be decoded: %v", ce, err)
+			return ret
+		}
+		body = b
+		ret.Note = fmt.Sprintf("decoded from Content-Encoding %s", ce)
+	}
+
+	formatBody(ret, ret.ContentType, body)
+	return ret
+}
+
+func formatBody(ret *InspectedBody, contentType string, body []byte) {
+	mt, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			var keys []string
+			for k := range values {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				for _, v := range values[k] {
+					ret.Form = append(ret.Form, HARNameValue{Name: k, Value: v})
+				}
+			}
+			ret.Kind = "form"
+			ret.Text = string(body)
+			ret.Raw = ret.Text
+			return
+		}
+	case strings.HasPrefix(mt, "multipart/"):
+		if parts, err := parseMultipart(body, params["boundary"]); err == nil {
+			ret.Kind = "multipart"
+			ret.Parts = parts
+			if utf8.Valid(body) {
+				ret.Raw = string(body)
+			}
+			return
+		}
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		buf := &bytes.Buffer{}
+		if err := json.Indent(buf, body, "", "  "); err == nil {
+			ret.Kind = "json"
+			ret.Text = buf.String()
+			ret.Raw = string(body)
+			return
+		}
+	}
+
+	if !utf8.Valid(body) {
+		ret.Kind = "binary"
+		return
+	}
+	ret.Kind = "text"
+	ret.Text = string(body)
+	ret.Raw = ret.Text
+}
+
+func parseMultipart(body []byte, boundary string) ([]InspectedPart, error) {
+	var parts []InspectedPart
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return parts, nil
+			}
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		pb := &InspectedBody{
+			Size:        len(b),
+			ContentType: p.Header.Get("Content-Type"),
+			Base64:      base64.StdEncoding.EncodeToString(b),
+		}
+		formatBody(pb, pb.ContentType, b)
+		parts = append(parts, InspectedPart{Header: http.Header(p.Header), Body: pb})
+	}
+}
+
+// ReplayEdit is the modification of the request to replay. Empty fields are not modified.
+type ReplayEdit struct {
+	Method string      `json:"method"`
+	URI    string      `json:"uri"`
+	Header http.Header `json:"header"`
+	Body   *string     `json:"body"`
+}
+
+// Apply returns the copy of the request which is modified by the edit.
+func (edit ReplayEdit) Apply(orig *HookRequest) *HookRequest {
+	hreq := &HookRequest{
+		RequestPayload: forward.RequestPayload{
+			Method:     orig.Method,
+			RequestURI: orig.RequestURI,
+			Header:     http.Header{},
+			Body:       orig.Body,
+		},
+	}
+	for k, v := range orig.Header {
+		hreq.Header[k] = append([]string(nil), v...)
+	}
+	if edit.Method != "" {
+		hreq.Method = edit.Method
+	}
+	if edit.URI != "" {
+		hreq.RequestURI = edit.URI
+	}
+	if edit.Header != nil {
+		hreq.Header = edit.Header
+	}
+	if edit.Body != nil {
+		hreq.Body = []byte(*edit.Body)
+		if hreq.Header.Get("Content-Length") != "" {
+			hreq.Header.Set("Content-Length", strconv.Itoa(len(hreq.Body)))
+		}
+	}
+	return hreq
+}
+
+// Replay re-sends the request of the exchange with the edit.
+func (in *Inspector) Replay(ctx context.Context, id int64, edit ReplayEdit) (*forward.ResponsePayload, error) {
+	e := in.find(id)
+	if e == nil {
+		return nil, fmt.Errorf("exchange not found: %d", id)
+	}
+	hreq := edit.Apply(e.Request)
+
+	if in.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, in.Timeout)
+		defer cancel()
+	}
+	return in.Consumer.forward(WithReplay(ctx), hreq)
+}
+
+// Handler returns the handler of web UI.
+func (in *Inspector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, inspectorHTML)
+	})
+	mux.HandleFunc("/api/exchanges", in.handleList)
+	mux.HandleFunc("/api/exchanges/", in.handleExchange)
+	mux.HandleFunc("/api/events", in.handleEvents)
+	if in.Holder != nil {
+		mux.HandleFunc("/api/hold", in.handleHold)
+		mux.HandleFunc("/api/held/", in.handleHeld)
+	}
+	return in.guard(mux)
+}
+
+// guard rejects requests from other sites, since web UI has no authentication.
+// Host must be loopback against DNS rebinding.
+// POST must be JSON from the same origin, which other sites can not send without CORS preflight.
+func (in *Inspector) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !in.AnyHost && !isLoopbackHost(r.Host) {
+			writeJSONError(w, http.StatusForbidden, fmt.Errorf("host is not loopback: %s", r.Host))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				writeJSONError(w, http.StatusUnsupportedMediaType, fmt.Errorf("content-type must be application/json"))
+				return
+			}
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					writeJSONError(w, http.StatusForbidden, fmt.Errorf("cross-origin request: %s", origin))
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether host or host:port is localhost or loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("*** Encode: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (in *Inspector) handleList(w http.ResponseWriter, r *http.Request) {
+	in.mu.Lock()
+	list := make([]ExchangeSummary, 0, len(in.entries))
+	for _, e := range in.entries {
+		list = append(list, e.Summary())
+	}
+	in.mu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleExchange serves GET /api/exchanges/{id} and POST /api/exchanges/{id}/replay
+func (in *Inspector) handleExchange(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/exchanges/")
+	idText, action := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		idText, action = rest[:i], rest[i+1:]
+	}
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		e := in.find(id)
+		if e == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, e.Detail())
+	case action == "replay" && r.Method == http.MethodPost:
+		var edit ReplayEdit
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		res, err := in.Replay(r.Context(), id, edit)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"status": res.StatusCode})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEvents streams summaries of new exchanges as server-sent events.
+func (in *Inspector) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := in.subscribe()
+	defer in.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(time.Second * 30)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-ch:
+			b, err := json.Marshal(e.Summary())
+			if err != nil {
+				logger.Errorf("*** json.Marshal: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		}
+		flusher.Flush()
+	}
+}
+
+// HeldSummary is the held request shown in web UI.
+type HeldSummary struct {
+	ID       string         `json:"id"`
+	Since    time.Time      `json:"since"`
+	Deadline time.Time      `json:"deadline"`
+	Method   string         `json:"method"`
+	URI      string         `json:"uri"`
+	Header   http.Header    `json:"header"`
+	Body     *InspectedBody `json:"body"`
+}
+
+// handleHold serves GET /api/hold which returns held requests and POST /api/hold which switches holding.
+func (in *Inspector) handleHold(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		in.Holder.Enabled.SetEnabled(req.Enabled)
+		logger.Infof("hold=%t by web UI", req.Enabled)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := []HeldSummary{}
+	for _, e := range in.Holder.List() {
+		list = append(list, HeldSummary{
+			ID:       e.ID,
+			Since:    e.Since,
+			Deadline: e.Deadline,
+			Method:   e.Request.Method,
+			URI:      e.Request.RequestURI,
+			Header:   e.Request.Header,
+			Body:     NewInspectedBody(e.Request.Header, e.Request.Body),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":  in.Holder.Enabled.Enabled(),
+		"requests": list,
+	})
+}
+
+// handleHeld serves POST /api/held/{id}/release and POST /api/held/{id}/reject
+func (in *Inspector) handleHeld(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/held/")
+	i := strings.Index(rest, "/")
+	if i < 0 || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	id, action := rest[:i], rest[i+1:]
+
+	hr := in.Holder.Get(id)
+	if hr == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("request is not held: %s", id))
+		return
+	}
+
+	d := &forward.HoldDecision{Action: action}
+	switch action {
+	case forward.HoldActionRelease:
+		var edit ReplayEdit
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		d.Request = &edit.Apply(hr.Request).RequestPayload
+	case forward.HoldActionReject:
+		if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		d.Action = forward.HoldActionReject
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if !in.Holder.Decide(id, d) {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("request is not held: %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"action": action})
+}
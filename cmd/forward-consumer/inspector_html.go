@@ -0,0 +1,271 @@
+package main
+
+// inspectorHTML is the single page of web UI served by Inspector.
+const inspectorHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>forward-consumer inspector</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 0; display: flex; height: 100vh; }
+#list { width: 55%; overflow: auto; border-right: 1px solid #ccc; }
+#detail { width: 45%; overflow: auto; padding: 0 12px; }
+#toolbar { position: sticky; top: 0; background: #f4f4f4; padding: 6px; border-bottom: 1px solid #ccc; }
+#toolbar input { width: 60%; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 3px 6px; white-space: nowrap; }
+td.uri { max-width: 320px; overflow: hidden; text-overflow: ellipsis; }
+tr.row { cursor: pointer; }
+tr.row:hover { background: #eef; }
+tr.selected { background: #dde; }
+.s2 { color: #080; } .s3 { color: #058; } .s4 { color: #b60; } .s5, .err { color: #c00; }
+.replay { color: #888; font-style: italic; }
+pre { background: #f8f8f8; padding: 6px; white-space: pre-wrap; word-break: break-all; }
+h3 { margin: 14px 0 4px; }
+.hdr td { padding: 1px 6px; vertical-align: top; }
+.hdr td:first-child { color: #555; }
+textarea { width: 100%; font-family: monospace; }
+#held table { background: #fff6dd; }
+#held:empty { display: none; }
+</style>
+</head>
+<body>
+<div id="list">
+  <div id="toolbar">
+    <input id="q" placeholder="filter: text in method, uri, host, route, status. e.g. POST /webhook 500">
+    <span id="count"></span> <span id="live"></span>
+    <label id="hold-switch" style="display: none"><input type="checkbox" id="hold" onchange="setHold(this.checked)"> hold</label>
+  </div>
+  <div id="held"></div>
+  <table>
+    <thead><tr><th>#</th><th>time</th><th>method</th><th>uri</th><th>route</th><th>status</th><th>ms</th><th>req</th><th>res</th></tr></thead>
+    <tbody id="rows"></tbody>
+  </table>
+</div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+var exchanges = [];
+var selected = null;
+var selectedRaw = null;
+
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, function (c) {
+    return {'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'}[c];
+  });
+}
+
+function statusClass(e) {
+  if (e.error) return 'err';
+  return 's' + String(e.status).charAt(0);
+}
+
+function matches(e, q) {
+  if (!q) return true;
+  var text = [e.method, e.uri, e.host, e.route, e.status, e.error || '', e.replay ? 'replay' : ''].join(' ').toLowerCase();
+  return q.toLowerCase().split(/\s+/).every(function (w) { return text.indexOf(w) >= 0; });
+}
+
+function render() {
+  var q = document.getElementById('q').value.trim();
+  var html = [];
+  var n = 0;
+  for (var i = exchanges.length - 1; i >= 0; i--) {
+    var e = exchanges[i];
+    if (!matches(e, q)) continue;
+    n++;
+    html.push('<tr class="row' + (e.id === selected ? ' selected' : '') + (e.replay ? ' replay' : '') + '" onclick="show(' + e.id + ')">' +
+      '<td>' + e.id + '</td>' +
+      '<td>' + esc(new Date(e.begin).toLocaleTimeString()) + '</td>' +
+      '<td>' + esc(e.method) + '</td>' +
+      '<td class="uri" title="' + esc(e.uri) + '">' + esc(e.uri) + '</td>' +
+      '<td>' + esc(e.route) + '</td>' +
+      '<td class="' + statusClass(e) + '">' + (e.error ? 'error' : e.status) + '</td>' +
+      '<td>' + e.millis.toFixed(1) + '</td>' +
+      '<td>' + e.requestSize + '</td>' +
+      '<td>' + e.responseSize + '</td></tr>');
+  }
+  document.getElementById('rows').innerHTML = html.join('');
+  document.getElementById('count').textContent = n + '/' + exchanges.length;
+}
+
+function headerTable(h) {
+  var keys = Object.keys(h || {}).sort();
+  return '<table class="hdr">' + keys.map(function (k) {
+    return h[k].map(function (v) { return '<tr><td>' + esc(k) + '</td><td>' + esc(v) + '</td></tr>'; }).join('');
+  }).join('') + '</table>';
+}
+
+function bodyView(b) {
+  if (!b || b.kind === 'empty') return '<p>(empty)</p>';
+  var html = '<p>' + esc(b.contentType || '-') + ', ' + b.size + ' bytes, ' + b.kind + (b.note ? ', ' + esc(b.note) : '') + '</p>';
+  if (b.kind === 'form') {
+    html += '<table class="hdr">' + b.form.map(function (f) {
+      return '<tr><td>' + esc(f.name) + '</td><td>' + esc(f.value) + '</td></tr>';
+    }).join('') + '</table>';
+  } else if (b.kind === 'multipart') {
+    html += b.parts.map(function (p, i) {
+      return '<h4>part ' + (i + 1) + '</h4>' + headerTable(p.header) + bodyView(p.body);
+    }).join('');
+  } else if (b.kind === 'binary') {
+    html += '<pre>' + esc(b.base64.substring(0, 4096)) + (b.base64.length > 4096 ? '...' : '') + '</pre>';
+  } else {
+    html += '<pre>' + esc(b.text) + '</pre>';
+  }
+  return html;
+}
+
+function headerText(h) {
+  var lines = [];
+  Object.keys(h || {}).sort().forEach(function (k) {
+    h[k].forEach(function (v) { lines.push(k + ': ' + v); });
+  });
+  return lines.join('\n');
+}
+
+function show(id) {
+  selected = id;
+  render();
+  fetch('api/exchanges/' + id).then(function (r) { return r.json(); }).then(function (d) {
+    document.getElementById('detail').innerHTML =
+      '<h2>#' + d.id + ' ' + esc(d.method) + ' ' + esc(d.uri) + '</h2>' +
+      '<p>host=' + esc(d.host) + ', route=' + esc(d.route) + ', status=' + d.status + ', ' + d.millis.toFixed(1) + 'ms' +
+      (d.replay ? ', replayed' : '') + '</p>' +
+      (d.error ? '<p class="err">' + esc(d.error) + '</p>' : '') +
+      '<h3>Request headers</h3>' + headerTable(d.requestHeader) +
+      '<h3>Request body</h3>' + bodyView(d.requestBody) +
+      '<h3>Response headers</h3>' + headerTable(d.responseHeader) +
+      '<h3>Response body</h3>' + bodyView(d.responseBody) +
+      '<h3>Replay</h3>' +
+      editForm(d.method, d.uri, d.requestHeader, d.requestBody) +
+      '<p><button onclick="replay(' + d.id + ')">Replay</button> <span id="r-result"></span></p>';
+  });
+}
+
+function editForm(method, uri, header, b) {
+  var editable = !b || b.kind === 'empty' || (b.raw !== '' && !b.note);
+  selectedRaw = editable && b ? b.raw : '';
+  return '<p><input id="r-method" size="8" value="' + esc(method) + '"> <input id="r-uri" size="60" value="' + esc(uri) + '"></p>' +
+    '<textarea id="r-header" rows="8">' + esc(headerText(header)) + '</textarea>' +
+    (editable ? '<textarea id="r-body" rows="8">' + esc(selectedRaw) + '</textarea>' : '<p>The body is sent as recorded.</p>');
+}
+
+function readEdit() {
+  var header = {};
+  document.getElementById('r-header').value.split('\n').forEach(function (line) {
+    var i = line.indexOf(':');
+    if (i <= 0) return;
+    var k = line.substring(0, i).trim();
+    (header[k] = header[k] || []).push(line.substring(i + 1).trim());
+  });
+  var edit = {
+    method: document.getElementById('r-method').value,
+    uri: document.getElementById('r-uri').value,
+    header: header
+  };
+  var body = document.getElementById('r-body');
+  if (body && body.value !== selectedRaw) edit.body = body.value;
+  return edit;
+}
+
+function postJSON(url, body) {
+  return fetch(url, {method: 'POST', headers: {'Content-Type': 'application/json'}, body: JSON.stringify(body)});
+}
+
+function replay(id) {
+  var edit = readEdit();
+  var result = document.getElementById('r-result');
+  result.textContent = 'sending...';
+  postJSON('api/exchanges/' + id + '/replay', edit)
+    .then(function (r) { return r.json(); })
+    .then(function (res) { result.textContent = res.error ? 'error: ' + res.error : 'status=' + res.status; });
+}
+
+function connect() {
+  var es = new EventSource('api/events');
+  es.onopen = function () {
+    document.getElementById('live').textContent = 'live';
+    fetch('api/exchanges').then(function (r) { return r.json(); }).then(function (list) {
+      exchanges = list;
+      render();
+    });
+  };
+  es.onmessage = function (ev) {
+    exchanges.push(JSON.parse(ev.data));
+    render();
+  };
+  es.onerror = function () {
+    document.getElementById('live').textContent = 'disconnected';
+  };
+}
+
+var held = [];
+
+function renderHeld() {
+  if (held.length === 0) {
+    document.getElementById('held').innerHTML = '';
+    return;
+  }
+  var now = Date.now();
+  document.getElementById('held').innerHTML = '<table><thead><tr><th>held</th><th>method</th><th>uri</th><th>left</th><th></th></tr></thead><tbody>' +
+    held.map(function (h) {
+      var left = h.deadline.indexOf('0001-') === 0 ? '-' : Math.max(0, Math.round((new Date(h.deadline).getTime() - now) / 1000)) + 's';
+      return '<tr class="row" onclick="showHeld(\'' + esc(h.id) + '\')"><td>' + esc(new Date(h.since).toLocaleTimeString()) + '</td>' +
+        '<td>' + esc(h.method) + '</td><td class="uri">' + esc(h.uri) + '</td><td>' + left + '</td>' +
+        '<td><button onclick="event.stopPropagation(); decide(\'' + esc(h.id) + '\', \'release\', {})">release</button> ' +
+        '<button onclick="event.stopPropagation(); decide(\'' + esc(h.id) + '\', \'reject\', {})">reject</button></td></tr>';
+    }).join('') + '</tbody></table>';
+}
+
+function showHeld(id) {
+  var h = held.filter(function (e) { return e.id === id; })[0];
+  if (!h) return;
+  selected = null;
+  render();
+  document.getElementById('detail').innerHTML =
+    '<h2>held ' + esc(h.method) + ' ' + esc(h.uri) + '</h2>' +
+    '<p>id=' + esc(h.id) + '</p>' +
+    '<h3>Request headers</h3>' + headerTable(h.header) +
+    '<h3>Request body</h3>' + bodyView(h.body) +
+    '<h3>Release</h3>' + editForm(h.method, h.uri, h.header, h.body) +
+    '<p><button onclick="decide(\'' + esc(h.id) + '\', \'release\', readEdit())">Release</button></p>' +
+    '<h3>Reject</h3>' +
+    '<p>status <input id="j-status" size="4" value="503"> message <input id="j-message" size="40"> ' +
+    '<button onclick="decide(\'' + esc(h.id) + '\', \'reject\', {statusCode: parseInt(document.getElementById(\'j-status\').value, 10), message: document.getElementById(\'j-message\').value})">Reject</button></p>' +
+    '<p id="r-result"></p>';
+}
+
+function decide(id, action, body) {
+  postJSON('api/held/' + encodeURIComponent(id) + '/' + action, body)
+    .then(function (r) { return r.json(); })
+    .then(function (res) {
+      var result = document.getElementById('r-result');
+      if (result) result.textContent = res.error ? 'error: ' + res.error : (action === 'release' ? 'released' : 'rejected');
+      pollHeld();
+    });
+}
+
+function setHold(enabled) {
+  postJSON('api/hold', {enabled: enabled}).then(pollHeld);
+}
+
+function pollHeld() {
+  return fetch('api/hold').then(function (r) {
+    if (r.status === 404) return null;
+    return r.json();
+  }).then(function (res) {
+    if (!res) return;
+    document.getElementById('hold-switch').style.display = '';
+    document.getElementById('hold').checked = res.enabled;
+    held = res.requests;
+    renderHeld();
+  });
+}
+
+document.getElementById('q').addEventListener('input', render);
+connect();
+pollHeld();
+setInterval(pollHeld, 1000);
+</script>
+</body>
+</html>
+`
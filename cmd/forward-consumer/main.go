@@ -4,28 +4,28 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"net/url"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"cloud.google.com/go/firestore"
-	"contrib.go.opencensus.io/exporter/stackdriver"
 	firebase "firebase.google.com/go"
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	forward "github.com/tckz/personal-forward"
-	"go.opencensus.io/exporter/stackdriver/propagation"
-	"go.opencensus.io/plugin/ochttp"
-	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/plugin/othttp"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc/codes"
@@ -35,27 +35,61 @@ var myName string
 var logger *zap.SugaredLogger
 var version string
 
+// dumpOutput is the destination of --dump and --dump-forward.
+var dumpOutput io.Writer = os.Stderr
+
 var (
-	optJSONKey         = flag.String("json-key", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), "/path/to/servicekey.json")
-	optWorkers         = flag.Int("workers", 8, "Number of goroutines to process request")
-	optDump            = flag.Bool("dump", false, "Dump received request or not")
-	optExpire          = flag.Duration("expire", time.Minute*2, "Ignore too old request")
-	optEndPointName    = flag.String("endpoint-name", "", "Identity of endpoint")
-	optWithoutCleaning = flag.Bool("without-cleaning", false, "Delete request documents that is expired")
-	optForwardTimeout  = flag.Duration("forward-timeout", time.Second*30, "Timeout for forwarding http request")
-	optPatterns        forward.StringArrayFlag
-	optTargets         forward.StringArrayFlag
-	optDumpForward     = flag.Bool("dump-forward", false, "Dump forward request and response")
-	optShowVersion     = flag.Bool("version", false, "Show version")
-	optMaxDumpBytes    = flag.Uint("max-dump-bytes", 4096, "Size condition for determine whether dump body of request/response or not.")
-	optChunkBytes      = flag.Uint("chunk-bytes", 1024*900, "Size of max chunk size of response")
+	optJSONKey          = flag.String("json-key", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), "/path/to/servicekey.json")
+	optWorkers          = flag.Int("workers", 8, "Number of goroutines to process request")
+	optExpire           = flag.Duration("expire", time.Minute*2, "Ignore too old request")
+	optEndPointName     = flag.String("endpoint-name", "", "Identity of endpoint")
+	optWithoutCleaning  = flag.Bool("without-cleaning", false, "Delete request documents that is expired")
+	optForwardTimeout   = flag.Duration("forward-timeout", time.Second*30, "Timeout for forwarding http request")
+	optPatterns         forward.StringArrayFlag
+	optDump             forward.SwitchFlag
+	optDumpForward      forward.SwitchFlag
+	optTargets          forward.StringArrayFlag
+	optShowVersion      = flag.Bool("version", false, "Show version")
+	optMaxDumpBytes     = flag.Uint("max-dump-bytes", 4096, "Size condition for determine whether dump body of request/response or not.")
+	optChunkBytes       = flag.Uint("chunk-bytes", 1024*900, "Size of max chunk size of response")
+	optPayloadKeys      = flag.String("payload-keys", os.Getenv("PAYLOAD_KEYS"), "Keys to encrypt payloads. 'id:base64key' separated by commas or @/path/to/keyfile. The first key is used to encrypt")
+	optCompress         = flag.String("compress", "", "Compress response body stored in Firestore. gzip or zstd")
+	optCompressMinBytes = flag.Int("compress-min-bytes", 1024, "Body smaller than this is not compressed")
+	optHook             = flag.String("hook", "", "/path/to/hook.lua which modifies request and response")
+	optSweepInterval    = flag.Duration("sweep-interval", 0, "Interval to delete expired requests and orphaned chunks of all endpoints. 0 is disabled")
+	optSweepExpire      = flag.Duration("sweep-expire", time.Minute*10, "Requests older than this are deleted by sweeper")
+	optSweepDryRun      = flag.Bool("sweep-dry-run", false, "Sweeper only reports documents to be deleted")
+	optBindStats        = flag.String("bind-stats", "", "Listen addr:port for pprof and /metrics. e.g. :3002")
+	optTraceExporter    = flag.String("trace-exporter", forward.TraceExporterNone, "Exporter of traces. otlp, stdout or none")
+	optOTLPAddress      = flag.String("otlp-address", "localhost:55680", "host:port of OpenTelemetry collector for --trace-exporter otlp")
+	optAPIKey           = flag.String("api-key", os.Getenv("FORWARD_API_KEY"), "API key of the registered endpoint. It is checked at startup against misconfiguration, not to protect Firestore")
+	optLegacyEndpoint   = flag.Bool("allow-unregistered-endpoint", false, "Accept the endpoint which is not registered or has no API key, as older versions did")
+	optRecord           = flag.String("record", "", "/path/to/dir to record forwarded requests and responses as HAR files")
+	optRecordMaxEntries = flag.Int("record-max-entries", 1000, "Number of entries per HAR file. 0 is unlimited")
+	optReplay           forward.StringArrayFlag
+	optReplayPath       = flag.String("replay-path", "", "Replay only requests whose path matches this pattern")
+	optReplayMethod     = flag.String("replay-method", "", "Replay only requests of this method")
+	optReplaySince      = flag.String("replay-since", "", "Replay only requests recorded at or after this time. RFC3339")
+	optReplayUntil      = flag.String("replay-until", "", "Replay only requests recorded before this time. RFC3339")
+	optReplayWorkers    = flag.Int("replay-workers", 1, "Number of requests replayed concurrently")
+	optReplayHeaders    forward.StringArrayFlag
+	optReplayDiff       = flag.Bool("replay-diff", false, "Show difference between recorded response and new response")
+	optBindUI           = flag.String("bind-ui", "", "Listen addr:port for web UI to inspect and replay requests. e.g. localhost:4040")
+	optBindUIExposed    = flag.Bool("bind-ui-exposed", false, "Allow --bind-ui to listen on non-loopback address. Web UI has no authentication")
+	optUIMaxEntries     = flag.Int("ui-max-entries", 500, "Number of recent requests kept for web UI")
+	optTUI              = flag.Bool("tui", false, "Show recent requests and state on the terminal instead of logs")
+	optHold             = flag.Bool("hold", false, "Hold requests until they are released or rejected by forwardctl, web UI or TUI")
 )
 
 func init() {
 	godotenv.Load()
 
 	flag.Var(&optPatterns, "pattern", "Path pattern for target.")
-	flag.Var(&optTargets, "target", "URL of forwarding target.")
+	flag.Var(&optDump, "dump", "Dump received request or not")
+	flag.Var(&optDumpForward, "dump-forward", "Dump forward request and response")
+	flag.Var(&optTargets, "target", "URL of forwarding target. file:///dir or mock:[status][?query] is also available.")
+	flag.Var(&optReplay, "replay", "/path/to/recorded.har or .jsonl. Replay recorded requests to targets instead of listening Firestore")
+	flag.Var(&optReplayHeaders, "replay-header", "'Name: value' which overrides the header of replayed requests. Empty value removes the header")
 	flag.Parse()
 
 	myName = filepath.Base(os.Args[0])
@@ -97,6 +131,29 @@ func run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	inflight := NewInflight()
+	gate := &Gate{}
+	holder := NewHolder()
+	holder.Enabled.SetEnabled(*optHold)
+
+	var tui *TUI
+	if *optTUI && len(optReplay) == 0 {
+		tui = NewTUI()
+		tui.Workers = *optWorkers
+		tui.Inflight = inflight
+		tui.Gate = gate
+		tui.Holder = holder
+		tui.Dump = &optDump
+		tui.DumpForward = &optDumpForward
+		tui.Quit = cancel
+		if err := tui.Start(); err != nil {
+			logger.Fatalf("*** --tui: %v", err)
+		}
+		defer tui.Stop()
+		logger = newTUILogger(tui).With(zap.String("app", myName))
+		dumpOutput = tui
+	}
+
 	if len(optTargets) == 0 && len(optPatterns) == 0 {
 		optPatterns = append(optPatterns, "**")
 		optTargets = append(optTargets, "http://localhost:3010")
@@ -106,47 +163,136 @@ func run() {
 		logger.Fatalf("*** Number of patterns and targets must be same.")
 	}
 
-	replaceWildCard := strings.NewReplacer("**", ".*", "*", "[^/]*")
 	var targetPatterns []TargetPattern
 	for i, e := range optPatterns {
-		re := regexp.MustCompile("^" + replaceWildCard.Replace(e))
-		target := optTargets[i]
-		u, err := url.Parse(target)
+		tp, err := NewTargetPattern(e, optTargets[i])
 		if err != nil {
-			logger.Fatalf("*** url.Parse: %s, err=%v", target, err)
+			logger.Fatalf("*** NewTargetPattern: %v", err)
 		}
-		targetPatterns = append(targetPatterns, TargetPattern{
-			Pattern: re,
-			Target:  u,
-		})
+		targetPatterns = append(targetPatterns, tp)
 	}
 
 	logger.Infof("Patterns: %v", targetPatterns)
 
-	if *optEndPointName == "" {
-		logger.Fatalf("*** --endpoint-name must be specified")
+	if len(optReplay) == 0 {
+		if *optEndPointName == "" {
+			logger.Fatalf("*** --endpoint-name must be specified")
+		}
+		logger = logger.With(zap.String("endpoint", *optEndPointName))
 	}
 
-	logger = logger.With(zap.String("endpoint", *optEndPointName))
-
-	mr, err := miniredis.Run()
-	if err != nil {
-		logger.Fatalf("*** miniredis.Run: %v", err)
+	if *optBindStats != "" {
+		statsMux := http.NewServeMux()
+		statsMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		statsMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		statsMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		statsMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		statsMux.HandleFunc("/debug/pprof/", pprof.Index)
+		statsMux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			if err := http.ListenAndServe(*optBindStats, statsMux); err != nil && err != http.ErrServerClosed {
+				logger.With(zap.Error(err)).Fatalf("*** http.ListenAndServe")
+			}
+		}()
 	}
-	defer mr.Close()
 
 	var opts []option.ClientOption
 	if *optJSONKey != "" {
 		opts = append(opts, option.WithCredentialsFile(*optJSONKey))
 	}
 
-	exporter, err := stackdriver.NewExporter(stackdriver.Options{})
+	stopTracer, err := forward.InitTracer(*optTraceExporter, *optOTLPAddress, myName)
+	if err != nil {
+		logger.Fatalf("*** InitTracer: %v", err)
+	}
+	defer stopTracer()
+
+	consumer := &Consumer{
+		TargetPatterns: targetPatterns,
+		Client: &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Transport: othttp.NewTransport(newTransport(),
+				othttp.WithPropagators(forward.Propagators),
+			),
+		},
+		MaxDumpBytes:     uint64(*optMaxDumpBytes),
+		Compress:         *optCompress,
+		CompressMinBytes: *optCompressMinBytes,
+	}
+
+	if err := forward.ValidateEncoding(*optCompress); err != nil {
+		logger.Fatalf("*** --compress: %v", err)
+	}
+
+	if *optPayloadKeys != "" {
+		kr, err := forward.LoadKeyring(*optPayloadKeys)
+		if err != nil {
+			logger.Fatalf("*** LoadKeyring: %v", err)
+		}
+		logger.Infof("Payloads are encrypted with key=%s", kr.CurrentID)
+		consumer.Keyring = kr
+	}
+
+	if *optHook != "" {
+		// One LState per worker.
+		size := *optWorkers
+		if len(optReplay) > 0 {
+			size = *optReplayWorkers
+		}
+		hook, err := NewLuaHook(*optHook, size)
+		if err != nil {
+			logger.Fatalf("*** NewLuaHook: %v", err)
+		}
+		defer hook.Close()
+		consumer.Hook = hook
+	}
+
+	if *optRecord != "" {
+		recorder, err := NewHARRecorder(*optRecord, *optRecordMaxEntries)
+		if err != nil {
+			logger.Fatalf("*** NewHARRecorder: %v", err)
+		}
+		defer recorder.Close()
+		consumer.Recorders = append(consumer.Recorders, recorder)
+	}
+
+	if len(optReplay) > 0 {
+		replay(ctx, consumer)
+		return
+	}
+
+	consumer.Holder = holder
+	if tui != nil {
+		consumer.Recorders = append(consumer.Recorders, tui)
+	}
+
+	if *optBindUI != "" {
+		host, _, err := net.SplitHostPort(*optBindUI)
+		if err != nil {
+			logger.Fatalf("*** --bind-ui: %v", err)
+		}
+		if !isLoopbackHost(host) && !*optBindUIExposed {
+			logger.Fatalf("*** --bind-ui must be loopback address unless --bind-ui-exposed is specified: %s", *optBindUI)
+		}
+		inspector := NewInspector(consumer, *optUIMaxEntries, *optForwardTimeout)
+		inspector.Holder = holder
+		inspector.AnyHost = *optBindUIExposed
+		consumer.Recorders = append(consumer.Recorders, inspector)
+		go func() {
+			logger.Infof("Web UI: http://%s/", *optBindUI)
+			if err := http.ListenAndServe(*optBindUI, inspector.Handler()); err != nil && err != http.ErrServerClosed {
+				logger.With(zap.Error(err)).Fatalf("*** http.ListenAndServe")
+			}
+		}()
+	}
+
+	mr, err := miniredis.Run()
 	if err != nil {
-		logger.Fatalf("*** stackdriver.NewExporter(): %v", err)
+		logger.Fatalf("*** miniredis.Run: %v", err)
 	}
-	defer exporter.Flush()
-	octrace.RegisterExporter(exporter)
-	octrace.ApplyConfig(octrace.Config{DefaultSampler: octrace.AlwaysSample()})
+	defer mr.Close()
 
 	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
 		Addrs:        []string{mr.Addr()},
@@ -160,21 +306,6 @@ func run() {
 	})
 	defer redisClient.Close()
 
-	consumer := &Consumer{
-		TargetPatterns: targetPatterns,
-		Propagation:    &propagation.HTTPFormat{},
-		Client: &http.Client{
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-			Transport: &ochttp.Transport{
-				Propagation:    &propagation.HTTPFormat{},
-				NewClientTrace: ochttp.NewSpanAnnotatingClientTrace,
-			},
-		},
-		MaxDumpBytes: uint64(*optMaxDumpBytes),
-	}
-
 	app, err := firebase.NewApp(ctx, nil, opts...)
 	if err != nil {
 		logger.Fatalf("*** firebase.NewApp: %v", err)
@@ -186,10 +317,23 @@ func run() {
 	}
 	defer client.Close()
 
+	if err := forward.VerifyEndpoint(ctx, client, *optEndPointName, *optAPIKey, *optLegacyEndpoint); err != nil {
+		logger.Fatalf("*** VerifyEndpoint: %v", err)
+	}
+
+	if *optSweepInterval > 0 {
+		sweeper := &forward.Sweeper{
+			Client: client,
+			Expire: *optSweepExpire,
+			DryRun: *optSweepDryRun,
+		}
+		go sweeper.Run(forward.WithLogger(ctx, logger.Desugar()), *optSweepInterval)
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 
-	ch := make(chan *firestore.DocumentSnapshot, *optWorkers)
+	queue := NewDocQueue()
 	wg := &sync.WaitGroup{}
 	go func() {
 		s := <-sigCh
@@ -205,8 +349,30 @@ func run() {
 
 			ctx := forward.WithLogger(ctx, logger.Desugar())
 
-			for doc := range ch {
+			for {
+				doc, ok := queue.Pop()
+				if !ok {
+					break
+				}
+				if err := gate.Wait(ctx); err != nil {
+					inflight.Done(doc.Ref.ID)
+					continue
+				}
 				func() {
+					id := doc.Ref.ID
+					requestID := forward.RequestIDOf(doc)
+					logger := logger.With(zap.String("requestId", requestID))
+					ctx := forward.WithRequestID(ctx, requestID)
+					defer inflight.Done(id)
+					ctx, ok := inflight.Start(ctx, id)
+					if !ok {
+						logger.Infof("Skip cancelled request: id=%s", id)
+						return
+					}
+
+					metricInflightWorkers.Inc()
+					defer metricInflightWorkers.Dec()
+
 					ctx, cancel := context.WithTimeout(ctx, *optForwardTimeout)
 					defer cancel()
 
@@ -226,6 +392,10 @@ func run() {
 		Snapshots(ctx)
 	defer it.Stop()
 
+	if tui != nil {
+		tui.SetState("connecting")
+	}
+
 	const iso8601Format = "2006-01-02T15:04:05.000Z0700"
 	for {
 		snapshot, err := it.Next()
@@ -235,14 +405,43 @@ func run() {
 			}
 			logger.Fatalf("*** it.Next: %v", err)
 		}
+		if tui != nil {
+			tui.SetState("listening")
+		}
 
 		for i, e := range snapshot.Changes {
 			created, _ := forward.AsTime(e.Doc.DataAt("created"))
-			uri, _ := forward.AsString(e.Doc.DataAt("request.httpInfo.requestURI"))
-			logger.Infof("[%d]: kind=%d, id=%s, created=%s, uri=%s",
-				i, e.Kind, e.Doc.Ref.ID, created.Format(iso8601Format), uri)
-			if *optDump {
-				fmt.Fprintf(os.Stderr, "%v\n", e.Doc.Data())
+			var uri string
+			if req, err := forward.DecodeRequest(e.Doc, consumer.Keyring); err == nil {
+				uri = req.RequestURI
+			}
+			logger.Infof("[%d]: kind=%d, id=%s, requestId=%s, created=%s, uri=%s",
+				i, e.Kind, e.Doc.Ref.ID, forward.RequestIDOf(e.Doc), created.Format(iso8601Format), uri)
+			if optDump.Enabled() {
+				fmt.Fprintf(dumpOutput, "# requestId=%s\n%v\n", forward.RequestIDOf(e.Doc), e.Doc.Data())
+			}
+
+			// The forwarder has given up the request.
+			if e.Kind == firestore.DocumentRemoved || e.Kind == firestore.DocumentModified && isCancelled(e.Doc) {
+				if inflight.Cancel(e.Doc.Ref.ID) {
+					logger.Infof("Cancel request: id=%s", e.Doc.Ref.ID)
+				}
+				continue
+			}
+
+			// The decision for the held request is written by forwardctl.
+			if e.Kind == firestore.DocumentModified {
+				d, err := forward.DecodeDecision(e.Doc, consumer.Keyring)
+				if err != nil {
+					logger.Errorf("*** DecodeDecision: id=%s, %v", e.Doc.Ref.ID, err)
+					continue
+				}
+				if d != nil {
+					if !holder.Decide(e.Doc.Ref.ID, d) {
+						logger.Infof("Ignore decision for the request which is not held: id=%s", e.Doc.Ref.ID)
+					}
+					continue
+				}
 			}
 
 			// Skip the doc that is too old.
@@ -265,15 +464,137 @@ func run() {
 					// The doc is assumed to be processed.
 				} else if !set {
 					// Ignore the doc that has already processed.
+					metricDedupHits.Inc()
 					continue
 				}
 
-				ch <- e.Doc
+				if tui != nil {
+					tui.Received()
+				}
+				inflight.Queue(e.Doc.Ref.ID)
+				queue.Push(e.Doc)
 			}
 		}
 	}
-	close(ch)
+	queue.Close()
 
 	logger.Infof("Waiting workers exit")
 	wg.Wait()
 }
+
+func isCancelled(doc *firestore.DocumentSnapshot) bool {
+	v, _ := doc.DataAt("cancelled")
+	return v != nil
+}
+
+// replay re-sends recorded requests specified by --replay instead of listening Firestore.
+func replay(ctx context.Context, consumer *Consumer) {
+	var filter ReplayFilter
+	if *optReplayPath != "" {
+		re, err := NewPathFilter(*optReplayPath)
+		if err != nil {
+			logger.Fatalf("*** --replay-path: %v", err)
+		}
+		filter.Path = re
+	}
+	filter.Method = *optReplayMethod
+	for _, e := range []struct {
+		value string
+		t     *time.Time
+		name  string
+	}{
+		{*optReplaySince, &filter.Since, "--replay-since"},
+		{*optReplayUntil, &filter.Until, "--replay-until"},
+	} {
+		if e.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, e.value)
+		if err != nil {
+			logger.Fatalf("*** %s: %v", e.name, err)
+		}
+		*e.t = t
+	}
+
+	header := http.Header{}
+	for _, e := range optReplayHeaders {
+		kv := strings.SplitN(e, ":", 2)
+		if len(kv) != 2 {
+			logger.Fatalf("*** --replay-header must be 'Name: value': %s", e)
+		}
+		header[http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))] = []string{strings.TrimSpace(kv[1])}
+	}
+
+	var entries []HAREntry
+	for _, name := range optReplay {
+		es, err := LoadHAREntries(name)
+		if err != nil {
+			logger.Fatalf("*** LoadHAREntries: %v", err)
+		}
+		for _, e := range es {
+			if filter.Match(e) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	logger.Infof("Replaying %d requests", len(entries))
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case s := <-sigCh:
+			logger.Infof("Received signal: %s", s)
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	replayer := &Replayer{
+		Consumer:    consumer,
+		Concurrency: *optReplayWorkers,
+		Timeout:     *optForwardTimeout,
+		Header:      header,
+		Diff:        *optReplayDiff,
+		Out:         os.Stdout,
+	}
+	report := replayer.Run(ctx, entries)
+	logger.Infof("Replayed: total=%d, errors=%d, different=%d", report.Total, report.Errors, report.Different)
+}
+
+// newTransport returns the transport same as http.DefaultTransport except compression.
+// Transparent decompression is disabled, so that Content-Encoding of the upstream is relayed to the client as is.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+	}
+}
+
+// newTUILogger creates the logger which writes human readable lines to the log pane of TUI.
+func newTUILogger(tui *TUI) *zap.SugaredLogger {
+	cfg := zap.NewDevelopmentEncoderConfig()
+	cfg.EncodeTime = func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+		enc.AppendString(t.Format("15:04:05"))
+	}
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(cfg), zapcore.AddSync(tui), zap.InfoLevel)
+	return zap.New(core, zap.Hooks(func(e zapcore.Entry) error {
+		// The terminal must be restored before exit.
+		if e.Level >= zapcore.FatalLevel {
+			tui.Stop()
+			fmt.Fprintln(os.Stderr, e.Message)
+		}
+		return nil
+	})).Sugar()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "forward_consumer"
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Number of forwarded requests by target and status code. code is 'error' when forwarding failed.",
+	}, []string{"target", "code"})
+	metricQueueDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_duration_seconds",
+		Help:      "Latency from the forwarder creating the request to the consumer claiming it.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	metricUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Latency of the target.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"target"})
+	metricResponseChunks = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_chunks",
+		Help:      "Number of chunks of the response body.",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16, 32},
+	})
+	metricInflightWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_workers",
+		Help:      "Number of workers which are processing the request.",
+	})
+	metricFirestoreErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "firestore_errors_total",
+		Help:      "Number of errors of Firestore operations.",
+	}, []string{"op"})
+	metricDedupHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dedup_hits_total",
+		Help:      "Number of snapshot changes which are ignored because the request has already been processed.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRequests,
+		metricQueueDuration,
+		metricUpstreamDuration,
+		metricResponseChunks,
+		metricInflightWorkers,
+		metricFirestoreErrors,
+		metricDedupHits,
+	)
+}
+
+// targetLabel returns the label of the target which keeps cardinality low.
+func targetLabel(u *url.URL) string {
+	if u.Host == "" {
+		return u.Scheme + ":"
+	}
+	return u.Scheme + "://" + u.Host
+}
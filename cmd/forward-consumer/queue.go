@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+
+	"cloud.google.com/go/firestore"
+)
+
+// DocQueue passes request documents from the snapshot loop to workers.
+// Push never blocks, so that the loop keeps handling cancels and decisions
+// while all workers are paused or holding requests.
+type DocQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	docs   []*firestore.DocumentSnapshot
+	closed bool
+}
+
+func NewDocQueue() *DocQueue {
+	q := &DocQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push appends the document.
+func (q *DocQueue) Push(doc *firestore.DocumentSnapshot) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.docs = append(q.docs, doc)
+	q.cond.Signal()
+}
+
+// Pop blocks until a document is pushed. It returns false when the queue is closed and empty.
+func (q *DocQueue) Pop() (*firestore.DocumentSnapshot, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.docs) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	doc := q.docs[0]
+	q.docs[0] = nil
+	q.docs = q.docs[1:]
+	return doc, true
+}
+
+// Close wakes up workers. Documents already pushed are still popped.
+func (q *DocQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+)
+
+// LoadHAREntries reads entries from the HAR file, or JSONL file which has one HAR entry per line.
+func LoadHAREntries(name string) ([]HAREntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Open: %s", name)
+	}
+	defer f.Close()
+
+	if filepath.Ext(name) != ".jsonl" {
+		var har HARLog
+		if err := json.NewDecoder(f).Decode(&har); err != nil {
+			return nil, errors.Wrapf(err, "*** Decode: %s", name)
+		}
+		return har.Log.Entries, nil
+	}
+
+	var entries []HAREntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var e HAREntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "*** Unmarshal: %s:%d", name, line)
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrapf(err, "*** Scan: %s", name)
+	}
+	return entries, nil
+}
+
+// NewHookRequestFromHAR restores the request which was recorded.
+func NewHookRequestFromHAR(e HAREntry) (*HookRequest, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** url.Parse: %s", e.Request.URL)
+	}
+
+	header := http.Header{}
+	for _, h := range e.Request.Headers {
+		header.Add(h.Name, h.Value)
+	}
+	if header.Get("Host") == "" {
+		header.Set("Host", u.Host)
+	}
+
+	var body []byte
+	if pd := e.Request.PostData; pd != nil {
+		body, err = decodeHARText(pd.Text, pd.Encoding)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** postData")
+		}
+	}
+
+	return &HookRequest{
+		RequestPayload: forward.RequestPayload{
+			Method:     e.Request.Method,
+			RequestURI: u.RequestURI(),
+			Header:     header,
+			Body:       body,
+		},
+	}, nil
+}
+
+func decodeHARText(text, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(text), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(text)
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// ReplayFilter selects entries to replay. Zero value matches all entries.
+type ReplayFilter struct {
+	// Path is matched with the path of the request. Same wildcards as --pattern.
+	Path *regexp.Regexp
+	// Method is compared case-insensitively.
+	Method string
+	Since  time.Time
+	Until  time.Time
+}
+
+// NewPathFilter compiles the path pattern which has wildcards like --pattern.
+func NewPathFilter(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^" + replaceWildCard.Replace(pattern) + "$")
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** regexp.Compile: %s", pattern)
+	}
+	return re, nil
+}
+
+func (f ReplayFilter) Match(e HAREntry) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, e.Request.Method) {
+		return false
+	}
+	if !f.Since.IsZero() && e.StartedDateTime.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.StartedDateTime.Before(f.Until) {
+		return false
+	}
+	if f.Path != nil {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil || !f.Path.MatchString(u.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// Replayer re-sends recorded requests through the routing table of the consumer.
+type Replayer struct {
+	Consumer    *Consumer
+	Concurrency int
+	Timeout     time.Duration
+	// Header overrides headers of the recorded request. Empty value removes the header.
+	Header http.Header
+	// Diff writes the difference between the recorded response and the new response.
+	Diff bool
+	Out  io.Writer
+
+	mu sync.Mutex
+}
+
+// ReplayReport is the result of Replayer.Run.
+type ReplayReport struct {
+	Total     int
+	Errors    int
+	Different int
+}
+
+// Run replays entries and reports each result to Out.
+func (r *Replayer) Run(ctx context.Context, entries []HAREntry) *ReplayReport {
+	report := &ReplayReport{Total: len(entries)}
+
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ch := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				r.replay(ctx, i, entries[i], report)
+			}
+		}()
+	}
+
+loop:
+	for i := range entries {
+		select {
+		case <-ctx.Done():
+			break loop
+		case ch <- i:
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	return report
+}
+
+func (r *Replayer) replay(ctx context.Context, i int, e HAREntry, report *ReplayReport) {
+	hreq, err := NewHookRequestFromHAR(e)
+	if err == nil {
+		for k, v := range r.Header {
+			if len(v) == 0 || v[0] == "" {
+				hreq.Header.Del(k)
+			} else {
+				hreq.Header[k] = v
+			}
+		}
+	}
+
+	var res *forward.ResponsePayload
+	begin := time.Now()
+	if err == nil {
+		if r.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+			defer cancel()
+		}
+		res, err = r.Consumer.forward(WithReplay(ctx), hreq)
+	}
+	dur := time.Since(begin)
+
+	var diff []string
+	if err == nil {
+		diff, err = diffResponse(e.Response, res)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := fmt.Sprintf("[%d/%d] %s %s", i+1, report.Total, e.Request.Method, e.Request.URL)
+	if err != nil {
+		report.Errors++
+		fmt.Fprintf(r.Out, "%s: error: %v\n", prefix, err)
+		return
+	}
+	mark := "same"
+	if len(diff) > 0 {
+		report.Different++
+		mark = "different"
+	}
+	fmt.Fprintf(r.Out, "%s: status=%d, recorded=%d, dur=%s, %s\n", prefix, res.StatusCode, e.Response.Status, dur, mark)
+	if r.Diff {
+		for _, l := range diff {
+			fmt.Fprintln(r.Out, l)
+		}
+	}
+}
+
+// ignoredDiffHeaders are the headers which change every time.
+var ignoredDiffHeaders = map[string]bool{
+	"Date":           true,
+	"Content-Length": true,
+}
+
+// maxDiffLines limits the size of the line diff of text bodies.
+const maxDiffLines = 2000
+
+// diffResponse returns lines which describe the difference between the recorded response and the new response.
+func diffResponse(recorded HARResponse, res *forward.ResponsePayload) ([]string, error) {
+	var diff []string
+
+	if recorded.Status != res.StatusCode {
+		diff = append(diff, fmt.Sprintf("  status: -%d +%d", recorded.Status, res.StatusCode))
+	}
+
+	rh := http.Header{}
+	for _, h := range recorded.Headers {
+		rh.Add(h.Name, h.Value)
+	}
+	nh := http.Header{}
+	for k, v := range res.Header {
+		nh[http.CanonicalHeaderKey(k)] = append(nh[http.CanonicalHeaderKey(k)], v...)
+	}
+	keys := map[string]bool{}
+	for k := range rh {
+		keys[k] = true
+	}
+	for k := range nh {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		if !ignoredDiffHeaders[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		before := strings.Join(rh[k], ", ")
+		after := strings.Join(nh[k], ", ")
+		if before != after {
+			diff = append(diff, fmt.Sprintf("  header %s: -%q +%q", k, before, after))
+		}
+	}
+
+	body, err := decodeHARText(recorded.Content.Text, recorded.Content.Encoding)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** recorded content")
+	}
+	if bytes.Equal(body, res.Body) {
+		return diff, nil
+	}
+
+	if !utf8.Valid(body) || !utf8.Valid(res.Body) {
+		return append(diff, fmt.Sprintf("  body: binary differs, -%d bytes +%d bytes", len(body), len(res.Body))), nil
+	}
+	a := strings.Split(string(body), "\n")
+	b := strings.Split(string(res.Body), "\n")
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return append(diff, fmt.Sprintf("  body: differs, -%d lines +%d lines", len(a), len(b))), nil
+	}
+	diff = append(diff, "  body:")
+	for _, l := range withContext(diffLines(a, b), diffContextLines) {
+		diff = append(diff, "    "+l)
+	}
+	return diff, nil
+}
+
+// diffContextLines is the number of unchanged lines shown around changes.
+const diffContextLines = 2
+
+// withContext drops unchanged lines which are far from changes.
+func withContext(lines []string, n int) []string {
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l[0] == ' ' {
+			continue
+		}
+		for j := i - n; j <= i+n; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	var ret []string
+	skipped := false
+	for i, l := range lines {
+		if !keep[i] {
+			skipped = true
+			continue
+		}
+		if skipped && len(ret) > 0 {
+			ret = append(ret, "...")
+		}
+		skipped = false
+		ret = append(ret, l)
+	}
+	return ret
+}
+
+// diffLines returns the line diff of a and b based on the longest common subsequence.
+// Lines are prefixed with " ", "-" or "+".
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ret []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ret = append(ret, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ret = append(ret, "-"+a[i])
+			i++
+		default:
+			ret = append(ret, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ret = append(ret, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		ret = append(ret, "+"+b[j])
+	}
+	return ret
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+var replaceWildCard = strings.NewReplacer("**", ".*", "*", "[^/]*")
+
+type TargetPattern struct {
+	Pattern *regexp.Regexp
+	Target  *url.URL
+	// Handler serves the request in-process instead of forwarding it to Target.
+	// It is set when the target is "mock:" or "file://".
+	Handler http.Handler
+}
+
+func (p TargetPattern) String() string {
+	return fmt.Sprintf("%s => %s", p.Pattern, p.Target)
+}
+
+// NewTargetPattern builds TargetPattern from path pattern and target.
+//
+// target is one of:
+//
+//	http://host:port/path  forward to the web server.
+//	file:///dir            serve static files under the dir.
+//	mock:[status][?query]  respond fixed response. See NewMockHandler.
+func NewTargetPattern(pattern, target string) (TargetPattern, error) {
+	re, err := regexp.Compile("^" + replaceWildCard.Replace(pattern))
+	if err != nil {
+		return TargetPattern{}, errors.Wrapf(err, "*** regexp.Compile: %s", pattern)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return TargetPattern{}, errors.Wrapf(err, "*** url.Parse: %s", target)
+	}
+
+	tp := TargetPattern{
+		Pattern: re,
+		Target:  u,
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "file":
+		if u.Path == "" {
+			return TargetPattern{}, fmt.Errorf("directory must be specified: %s", target)
+		}
+		tp.Handler = http.FileServer(http.Dir(u.Path))
+	case "mock":
+		h, err := NewMockHandler(u)
+		if err != nil {
+			return TargetPattern{}, err
+		}
+		tp.Handler = h
+	default:
+		return TargetPattern{}, fmt.Errorf("unsupported scheme: %s", target)
+	}
+
+	return tp, nil
+}
+
+// ServeInProcess calls the Handler and returns its result as *http.Response.
+func (p TargetPattern) ServeInProcess(req *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	p.Handler.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+// MockHandler responds fixed status, header and body.
+type MockHandler struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Template is used instead of Body when it is not nil.
+	Template *template.Template
+}
+
+// MockRequest is the data passed to the body template of MockHandler.
+type MockRequest struct {
+	Method     string
+	RequestURI string
+	Path       string
+	Host       string
+	Query      url.Values
+	Header     http.Header
+	Body       string
+}
+
+// NewMockHandler creates MockHandler from "mock:" URL.
+//
+//	mock:204
+//	mock:?status=200&header=Content-Type:+application/json&body={"ok":true}
+//	mock:?body-file=/path/to/body.txt&template=true
+//
+// Query parameters:
+//
+//	status     Status code. Default is 200.
+//	header     "Name: value". Can be repeated.
+//	body       Inline body.
+//	body-file  Read body from the file.
+//	template   When true, the body is executed as text/template with MockRequest.
+func NewMockHandler(u *url.URL) (*MockHandler, error) {
+	q := u.Query()
+
+	h := &MockHandler{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+	}
+
+	status := q.Get("status")
+	if status == "" {
+		status = u.Opaque
+	}
+	if status != "" {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** invalid status: %s", status)
+		}
+		h.StatusCode = code
+	}
+
+	for _, e := range q["header"] {
+		kv := strings.SplitN(e, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("header must be 'Name: value': %s", e)
+		}
+		h.Header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	h.Body = []byte(q.Get("body"))
+	if f := q.Get("body-file"); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** ioutil.ReadFile: %s", f)
+		}
+		h.Body = b
+	}
+
+	if useTemplate, _ := strconv.ParseBool(q.Get("template")); useTemplate {
+		t, err := template.New(u.String()).Parse(string(h.Body))
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** template.Parse")
+		}
+		h.Template = t
+	}
+
+	return h, nil
+}
+
+func (h *MockHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := h.Body
+	if h.Template != nil {
+		b, _ := ioutil.ReadAll(r.Body)
+		buf := &bytes.Buffer{}
+		err := h.Template.Execute(buf, MockRequest{
+			Method:     r.Method,
+			RequestURI: r.RequestURI,
+			Path:       r.URL.Path,
+			Host:       r.Host,
+			Query:      r.URL.Query(),
+			Header:     r.Header,
+			Body:       string(b),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = buf.Bytes()
+	}
+
+	for k, values := range h.Header {
+		for _, e := range values {
+			w.Header().Add(k, e)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(h.StatusCode)
+	w.Write(body)
+}
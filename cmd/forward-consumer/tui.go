@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	forward "github.com/tckz/personal-forward"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+	ansiInvert = "\x1b[7m"
+)
+
+// tuiMaxLogs is the number of log lines kept for the log pane.
+const tuiMaxLogs = 200
+
+type routeCounter struct {
+	Count  int
+	Codes  [6]int
+	Errors int
+	Total  time.Duration
+}
+
+// TUI shows recent requests and state of the consumer on the terminal instead of JSON logs.
+// It receives exchanges as ExchangeRecorder and log lines as io.Writer.
+type TUI struct {
+	Workers  int
+	Inflight *Inflight
+	Gate     *Gate
+	Holder   *Holder
+	// Toggles are switched by keys.
+	Dump        *forward.SwitchFlag
+	DumpForward *forward.SwitchFlag
+	// Quit is called when q or Ctrl-C is pressed.
+	Quit func()
+	// MaxEntries is the number of recent requests kept.
+	MaxEntries int
+
+	mu           sync.Mutex
+	entries      []*Exchange
+	routes       map[string]*routeCounter
+	logs         []string
+	partial      []byte
+	state        string
+	stateSince   time.Time
+	lastReceived time.Time
+	started      time.Time
+
+	oldState *terminal.State
+	done     chan struct{}
+	stopOnce sync.Once
+	dirty    chan struct{}
+}
+
+func NewTUI() *TUI {
+	return &TUI{
+		MaxEntries: 200,
+		routes:     map[string]*routeCounter{},
+		state:      "starting",
+		stateSince: time.Now(),
+		started:    time.Now(),
+		done:       make(chan struct{}),
+		dirty:      make(chan struct{}, 1),
+	}
+}
+
+// Start switches the terminal to raw mode and starts drawing.
+func (t *TUI) Start() error {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return fmt.Errorf("stdin is not a terminal")
+	}
+	st, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	t.oldState = st
+	// Use the alternate screen and hide the cursor.
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+
+	go t.readKeys()
+	go t.drawLoop()
+	return nil
+}
+
+// Stop restores the terminal. It can be called more than once.
+func (t *TUI) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.done)
+		fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+		if t.oldState != nil {
+			terminal.Restore(int(os.Stdin.Fd()), t.oldState)
+		}
+	})
+}
+
+func (t *TUI) invalidate() {
+	select {
+	case t.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// SetState updates the connectivity state of the Firestore listener.
+func (t *TUI) SetState(state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != state {
+		t.state = state
+		t.stateSince = time.Now()
+	}
+	t.invalidate()
+}
+
+// Received marks the time when the request from the forwarder has arrived.
+func (t *TUI) Received() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastReceived = time.Now()
+	t.invalidate()
+}
+
+// Record adds the exchange to the table and the counter of its route.
+func (t *TUI) Record(ex *Exchange) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries = append(t.entries, ex)
+	if len(t.entries) > t.MaxEntries {
+		t.entries = t.entries[len(t.entries)-t.MaxEntries:]
+	}
+
+	rc := t.routes[ex.Route]
+	if rc == nil {
+		rc = &routeCounter{}
+		t.routes[ex.Route] = rc
+	}
+	rc.Count++
+	rc.Total += ex.Wait + ex.Receive
+	if ex.Response != nil && ex.Response.StatusCode/100 < len(rc.Codes) {
+		rc.Codes[ex.Response.StatusCode/100]++
+	} else {
+		rc.Errors++
+	}
+	t.invalidate()
+	return nil
+}
+
+// Write appends log lines to the log pane.
+func (t *TUI) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		t.logs = append(t.logs, strings.TrimRight(string(b[:i]), "\r"))
+		b = b[i+1:]
+	}
+	t.partial = append([]byte(nil), b...)
+	if len(t.logs) > tuiMaxLogs {
+		t.logs = t.logs[len(t.logs)-tuiMaxLogs:]
+	}
+	t.invalidate()
+	return len(p), nil
+}
+
+func (t *TUI) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, c := range buf[:n] {
+			switch c {
+			case 'q', 3: // Ctrl-C
+				if t.Quit != nil {
+					t.Quit()
+				}
+			case 'p':
+				if t.Gate.Toggle() {
+					logger.Infof("Paused forwarding")
+				} else {
+					logger.Infof("Resumed forwarding")
+				}
+			case 'd':
+				logger.Infof("dump-forward=%t", t.DumpForward.Toggle())
+			case 'D':
+				logger.Infof("dump=%t", t.Dump.Toggle())
+			case 'h':
+				logger.Infof("hold=%t", t.Holder.Enabled.Toggle())
+			case 'R':
+				logger.Infof("Released %d held requests", t.Holder.ReleaseAll())
+			case 'c':
+				t.mu.Lock()
+				t.entries = nil
+				t.routes = map[string]*routeCounter{}
+				t.logs = nil
+				t.mu.Unlock()
+			}
+			t.invalidate()
+		}
+	}
+}
+
+func (t *TUI) drawLoop() {
+	// Redraw periodically for elapsed times, and on changes at most 10 times per second.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		case <-t.dirty:
+		}
+		t.draw()
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func statusColor(ex *Exchange) string {
+	if ex.Response == nil {
+		return ansiRed
+	}
+	switch ex.Response.StatusCode / 100 {
+	case 2:
+		return ansiGreen
+	case 3:
+		return ansiCyan
+	case 4:
+		return ansiYellow
+	default:
+		return ansiRed
+	}
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
+
+// fit cuts the line to the width. The line must not contain escape sequences.
+func fit(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	if width < 1 {
+		return ""
+	}
+	return string(r[:width-1]) + "~"
+}
+
+func (t *TUI) draw() {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < 10 {
+		width, height = 80, 24
+	}
+
+	queued, active := t.Inflight.Counts()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lines []string
+	add := func(color, s string) {
+		s = fit(s, width)
+		if color != "" {
+			s = color + s + ansiReset
+		}
+		lines = append(lines, s)
+	}
+
+	state := fmt.Sprintf("%s %s  endpoint=%s  up %s", myName, version, *optEndPointName, time.Since(t.started).Truncate(time.Second))
+	if t.Gate.Paused() {
+		state += "  [PAUSED]"
+	}
+	if t.Holder.Enabled.Enabled() {
+		state += "  [HOLD]"
+	}
+	add(ansiBold, state)
+	add("", fmt.Sprintf("firestore: %s (%s)  last request from forwarder: %s",
+		t.state, since(t.stateSince), since(t.lastReceived)))
+	bar := strings.Repeat("#", active) + strings.Repeat(".", maxInt(t.Workers-active, 0))
+	add("", fmt.Sprintf("workers: %d/%d busy [%s]  queued: %d  held: %d  dump=%t  dump-forward=%t",
+		active, t.Workers, bar, queued, len(t.Holder.List()), t.Dump.Enabled(), t.DumpForward.Enabled()))
+
+	add(ansiInvert, fit(fmt.Sprintf("%-40s %6s %5s %5s %5s %5s %5s %9s", "route", "count", "2xx", "3xx", "4xx", "5xx", "err", "avg"), width))
+	var routes []string
+	for k := range t.routes {
+		routes = append(routes, k)
+	}
+	sort.Strings(routes)
+	for _, k := range routes {
+		rc := t.routes[k]
+		avg := time.Duration(0)
+		if rc.Count > 0 {
+			avg = rc.Total / time.Duration(rc.Count)
+		}
+		add("", fmt.Sprintf("%-40s %6d %5d %5d %5d %5d %5d %9s",
+			fit(k, 40), rc.Count, rc.Codes[2], rc.Codes[3], rc.Codes[4], rc.Codes[5], rc.Errors+rc.Codes[0]+rc.Codes[1], avg.Truncate(time.Microsecond*100)))
+	}
+
+	const logLines = 6
+	footer := "p:pause/resume  h:hold  R:release held  d:dump-forward  D:dump  c:clear  q:quit"
+	rows := height - len(lines) - 1 - (logLines + 1) - 1
+	add(ansiInvert, fit(fmt.Sprintf("%-8s %-7s %6s %9s %8s  %s", "time", "method", "status", "latency", "size", "uri"), width))
+	for i := len(t.entries) - 1; i >= 0 && rows > 0; i, rows = i-1, rows-1 {
+		ex := t.entries[i]
+		status := "error"
+		size := 0
+		if ex.Response != nil {
+			status = fmt.Sprint(ex.Response.StatusCode)
+			size = len(ex.Response.Body)
+		}
+		line := fmt.Sprintf("%-8s %-7s %6s %9s %8d  %s",
+			ex.Begin.Format("15:04:05"), ex.Request.Method, status, (ex.Wait + ex.Receive).Truncate(time.Microsecond*100),
+			size, ex.Request.RequestURI)
+		if ex.Error != nil {
+			line += "  " + ex.Error.Error()
+		}
+		color := statusColor(ex)
+		if ex.Replay {
+			color += ansiDim
+		}
+		add(color, line)
+	}
+	for ; rows > 0; rows-- {
+		add("", "")
+	}
+
+	add(ansiInvert, fit("log", width))
+	logs := t.logs
+	if len(logs) > logLines {
+		logs = logs[len(logs)-logLines:]
+	}
+	for i := 0; i < logLines; i++ {
+		if i < len(logs) {
+			add(ansiDim, logs[i])
+		} else {
+			add("", "")
+		}
+	}
+	add(ansiBold, footer)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("\x1b[H")
+	for i, l := range lines {
+		if i >= height {
+			break
+		}
+		buf.WriteString(l)
+		// Clear the rest of the line.
+		buf.WriteString("\x1b[K")
+		if i < len(lines)-1 && i < height-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString("\x1b[J")
+	os.Stdout.Write(buf.Bytes())
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
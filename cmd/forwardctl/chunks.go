@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"cloud.google.com/go/firestore"
+	forward "github.com/tckz/personal-forward"
+)
+
+func gcChunks(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("chunks gc", flag.ExitOnError)
+	fs.Parse(args)
+
+	refs, err := forward.OrphanedChunks(ctx, client)
+	if err != nil {
+		return err
+	}
+	if err := forward.DeleteRefs(ctx, client, refs); err != nil {
+		return err
+	}
+	logger.Infof("Deleted orphaned chunks=%d", len(refs))
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+)
+
+func registerEndpoint(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("endpoints register", flag.ExitOnError)
+	name := fs.String("name", "", "Name of the endpoint")
+	owner := fs.String("owner", "", "Owner of the endpoint. Current user by default")
+	disabled := fs.Bool("disabled", false, "Register the endpoint as disabled")
+	var hosts forward.StringArrayFlag
+	fs.Var(&hosts, "host", "Host name which is routed to the endpoint")
+	fs.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("--name must be specified")
+	}
+	if *owner == "" {
+		if u, err := user.Current(); err == nil {
+			*owner = u.Username
+		}
+	}
+
+	key, err := forward.GenerateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	ep := &forward.Endpoint{
+		Name:       *name,
+		Owner:      *owner,
+		Hosts:      hosts,
+		Created:    time.Now(),
+		Enabled:    !*disabled,
+		APIKeyHash: forward.HashAPIKey(key),
+	}
+	if ep.Hosts == nil {
+		ep.Hosts = []string{}
+	}
+	if err := forward.RegisterEndpoint(ctx, client, ep); err != nil {
+		return err
+	}
+
+	logger.Infof("Registered endpoint=%s, owner=%s, hosts=%v", ep.Name, ep.Owner, ep.Hosts)
+	// The key is shown only once. Only the hash is stored.
+	fmt.Fprintf(os.Stdout, "FORWARD_API_KEY=%s\n", key)
+	return nil
+}
+
+func listEndpoints(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("endpoints list", flag.ExitOnError)
+	fs.Parse(args)
+
+	// DocumentRefs includes endpoints which have requests but are not registered.
+	refs, err := client.Collection("endpoints").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return errors.Wrapf(err, "*** endpoints GetAll")
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	docs, err := client.GetAll(ctx, refs)
+	if err != nil {
+		return errors.Wrapf(err, "*** GetAll")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tOWNER\tENABLED\tHOSTS\tCREATED")
+	for _, e := range docs {
+		if !e.Exists() {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t(not registered)\n", e.Ref.ID)
+			continue
+		}
+		var ep forward.Endpoint
+		if err := e.DataTo(&ep); err != nil {
+			return errors.Wrapf(err, "*** DataTo: %s", e.Ref.ID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\n", e.Ref.ID, ep.Owner, ep.Enabled, strings.Join(ep.Hosts, ","), formatTime(ep.Created))
+	}
+	return w.Flush()
+}
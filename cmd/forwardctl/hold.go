@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+	"google.golang.org/grpc/codes"
+)
+
+// heldRequest reads the request document and checks it is held by forward-consumer.
+func heldRequest(ctx context.Context, client *firestore.Client, endpoint, id string, kr *forward.Keyring) (*firestore.DocumentSnapshot, error) {
+	doc, err := client.Collection("endpoints").Doc(endpoint).Collection("requests").Doc(id).Get(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Get: %s", id)
+	}
+	info := forward.NewRequestInfo(doc, kr)
+	if state := requestState(info); state != "held" {
+		return nil, fmt.Errorf("request is not held: id=%s, state=%s", id, state)
+	}
+	return doc, nil
+}
+
+// decide writes the decision to the request which is held by forward-consumer.
+// doc is the held request read by heldRequest. The update fails when the request has changed since then,
+// e.g. another decision, a timeout or a cancel.
+func decide(ctx context.Context, doc *firestore.DocumentSnapshot, kr *forward.Keyring, d *forward.HoldDecision) error {
+	id := doc.Ref.ID
+	val, err := forward.EncodeDecision(id, d, kr)
+	if err != nil {
+		return errors.Wrapf(err, "*** EncodeDecision")
+	}
+	updates := []firestore.Update{
+		{
+			Path:  "decision",
+			Value: val,
+		},
+	}
+	if d.Request != nil {
+		// The edited request replaces the original one, so that the document does not grow.
+		req, err := forward.EncodeRequest(id, d.Request, kr)
+		if err != nil {
+			return errors.Wrapf(err, "*** EncodeRequest")
+		}
+		updates = append(updates, firestore.Update{
+			Path:  "request",
+			Value: req,
+		})
+	}
+	if _, err := doc.Ref.Update(ctx, updates, firestore.LastUpdateTime(doc.UpdateTime)); err != nil {
+		if s, ok := err.(forward.GRPCStatusHolder); ok && s.GRPCStatus().Code() == codes.FailedPrecondition {
+			return fmt.Errorf("request has changed since it was read, try again: id=%s", id)
+		}
+		return errors.Wrapf(err, "*** Update decision: %s", id)
+	}
+	logger.Infof("Decided endpoint=%s, id=%s, action=%s", doc.Ref.Parent.Parent.ID, id, d.Action)
+	return nil
+}
+
+func releaseRequest(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("requests release", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "", "Name of the endpoint")
+	method := fs.String("method", "", "Replace method of the request")
+	uri := fs.String("uri", "", "Replace request URI of the request")
+	bodyFile := fs.String("body-file", "", "Replace body of the request with the file")
+	var headers forward.StringArrayFlag
+	fs.Var(&headers, "header", "'Name: value' which replaces the header of the request. Empty value removes the header")
+	fs.Parse(args)
+
+	if *endpoint == "" || fs.NArg() != 1 {
+		return fmt.Errorf("--endpoint and <id> must be specified")
+	}
+	id := fs.Arg(0)
+
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	doc, err := heldRequest(ctx, client, *endpoint, id, kr)
+	if err != nil {
+		return err
+	}
+
+	d := &forward.HoldDecision{Action: forward.HoldActionRelease}
+	if *method != "" || *uri != "" || *bodyFile != "" || len(headers) > 0 {
+		// The body is kept compressed unless it is replaced.
+		req, err := forward.DecodeRequest(doc, kr)
+		if err != nil {
+			return errors.Wrapf(err, "*** DecodeRequest")
+		}
+
+		if *method != "" {
+			req.Method = *method
+		}
+		if *uri != "" {
+			req.RequestURI = *uri
+		}
+		for _, e := range headers {
+			kv := strings.SplitN(e, ":", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("--header must be 'Name: value': %s", e)
+			}
+			k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			if v == "" {
+				req.Header.Del(k)
+			} else {
+				req.Header.Set(k, v)
+			}
+		}
+		if *bodyFile != "" {
+			b, err := ioutil.ReadFile(*bodyFile)
+			if err != nil {
+				return errors.Wrapf(err, "*** ReadFile: %s", *bodyFile)
+			}
+			encoding := req.Encoding
+			req.Body, req.Encoding = b, ""
+			if err := req.Compress(encoding, 0); err != nil {
+				return errors.Wrapf(err, "*** Compress")
+			}
+			if req.Header.Get("Content-Length") != "" {
+				req.Header.Set("Content-Length", fmt.Sprint(len(b)))
+			}
+		}
+		d.Request = req
+	}
+
+	return decide(ctx, doc, kr, d)
+}
+
+func rejectRequest(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("requests reject", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "", "Name of the endpoint")
+	status := fs.Int("status", http.StatusServiceUnavailable, "Status code of the response")
+	message := fs.String("message", "", "Body of the response")
+	fs.Parse(args)
+
+	if *endpoint == "" || fs.NArg() != 1 {
+		return fmt.Errorf("--endpoint and <id> must be specified")
+	}
+
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	doc, err := heldRequest(ctx, client, *endpoint, fs.Arg(0), kr)
+	if err != nil {
+		return err
+	}
+
+	return decide(ctx, doc, kr, &forward.HoldDecision{
+		Action:     forward.HoldActionReject,
+		StatusCode: *status,
+		Message:    *message,
+	})
+}
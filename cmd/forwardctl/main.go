@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"github.com/joho/godotenv"
+	forward "github.com/tckz/personal-forward"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+)
+
+var myName string
+var logger *zap.SugaredLogger
+var version string
+
+var (
+	optJSONKey     = flag.String("json-key", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), "/path/to/servicekey.json")
+	optShowVersion = flag.Bool("version", false, "Show version")
+	optPayloadKeys = flag.String("payload-keys", os.Getenv("PAYLOAD_KEYS"), "Keys to decrypt payloads. 'id:base64key' separated by commas or @/path/to/keyfile")
+)
+
+// command runs the subcommand with its arguments.
+type command func(ctx context.Context, client *firestore.Client, args []string) error
+
+var commands = map[string]command{
+	"endpoints register": registerEndpoint,
+	"endpoints list":     listEndpoints,
+	"requests list":      listRequests,
+	"requests show":      showRequest,
+	"requests purge":     purgeRequests,
+	"requests release":   releaseRequest,
+	"requests reject":    rejectRequest,
+	"requests sweep":     sweepRequests,
+	"chunks gc":          gcChunks,
+}
+
+func init() {
+	godotenv.Load()
+
+	flag.Usage = usage
+	flag.Parse()
+
+	myName = filepath.Base(os.Args[0])
+
+	zl, err := forward.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	logger = zl.Sugar().With(zap.String("app", myName))
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <command> [command options]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	var names []string
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, e := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", e)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	if *optShowVersion {
+		fmt.Fprintln(os.Stderr, version)
+		return
+	}
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := strings.Join(args[:2], " ")
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(name, cmd, args[2:]); err != nil {
+		logger.Fatalf("*** %s: %v", name, err)
+	}
+}
+
+func run(name string, cmd command, args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-sigCh
+		logger.Infof("Received signal: %v", s)
+		cancel()
+	}()
+
+	var opts []option.ClientOption
+	if *optJSONKey != "" {
+		opts = append(opts, option.WithCredentialsFile(*optJSONKey))
+	}
+
+	app, err := firebase.NewApp(ctx, nil, opts...)
+	if err != nil {
+		return fmt.Errorf("firebase.NewApp: %v", err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		return fmt.Errorf("app.Firestore: %v", err)
+	}
+	defer client.Close()
+
+	return cmd(ctx, client, args)
+}
+
+func loadKeyring() (*forward.Keyring, error) {
+	if *optPayloadKeys == "" {
+		return nil, nil
+	}
+	return forward.LoadKeyring(*optPayloadKeys)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+	"google.golang.org/api/iterator"
+)
+
+func requestState(info *forward.RequestInfo) string {
+	switch {
+	case !info.Responded.IsZero():
+		return "responded"
+	case !info.Held.IsZero():
+		return "held"
+	case !info.Claimed.IsZero():
+		return "claimed"
+	}
+	return "pending"
+}
+
+func listRequests(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("requests list", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "", "Name of the endpoint")
+	fs.Parse(args)
+
+	if *endpoint == "" {
+		return fmt.Errorf("--endpoint must be specified")
+	}
+
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	list, err := forward.ListRequests(ctx, client, *endpoint, kr)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAGE\tSTATE\tMETHOD\tURI")
+	for _, e := range list {
+		method, uri := e.Request.Method, e.Request.RequestURI
+		if e.DecodeError != nil {
+			method, uri = "-", fmt.Sprintf("(%v)", e.DecodeError)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.ID, now.Sub(e.Created).Truncate(time.Second), requestState(e), method, uri)
+	}
+	return w.Flush()
+}
+
+func showRequest(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("requests show", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "", "Name of the endpoint")
+	fs.Parse(args)
+
+	if *endpoint == "" || fs.NArg() != 1 {
+		return fmt.Errorf("--endpoint and <id> must be specified")
+	}
+
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	doc, err := client.Collection("endpoints").Doc(*endpoint).Collection("requests").Doc(fs.Arg(0)).Get(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "*** Get: %s", fs.Arg(0))
+	}
+
+	info := forward.NewRequestInfo(doc, kr)
+	fmt.Printf("ID: %s\nRequest ID: %s\nState: %s\nCreated: %s\nClaimed: %s\nHeld: %s\nResponded: %s\n\n",
+		info.ID, info.RequestID, requestState(info), formatTime(info.Created), formatTime(info.Claimed), formatTime(info.Held), formatTime(info.Responded))
+
+	if info.DecodeError != nil {
+		return errors.Wrapf(info.DecodeError, "*** DecodeRequest")
+	}
+	req := info.Request
+	fmt.Printf("%s %s\n", req.Method, req.RequestURI)
+	req.Header.Write(os.Stdout)
+	fmt.Printf("\n%s\n", req.Body)
+
+	if info.Responded.IsZero() {
+		return nil
+	}
+
+	res, err := loadResponse(ctx, doc, kr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n----\n")
+	if res.Error != "" {
+		fmt.Printf("Error: %s\n", res.Error)
+		return nil
+	}
+	fmt.Printf("%d %s\n", res.StatusCode, http.StatusText(res.StatusCode))
+	res.Header.Write(os.Stdout)
+	fmt.Printf("\n%s\n", res.Body)
+	return nil
+}
+
+// loadResponse decodes the response and joins its chunks.
+func loadResponse(ctx context.Context, doc *firestore.DocumentSnapshot, kr *forward.Keyring) (*forward.ResponsePayload, error) {
+	res, err := forward.DecodeResponse(doc, kr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** DecodeResponse")
+	}
+
+	if res.Chunks > 0 {
+		chunks := map[int64][]byte{}
+		it := doc.Ref.Collection("responseBodies").Documents(ctx)
+		defer it.Stop()
+		for {
+			chunkDoc, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "*** responseBodies it.Next")
+			}
+			index, chunk, err := forward.DecodeChunk(doc.Ref.ID, chunkDoc, kr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "*** DecodeChunk")
+			}
+			chunks[index] = chunk
+		}
+		if len(chunks) != res.Chunks {
+			return nil, fmt.Errorf("chunks are incomplete: %d/%d", len(chunks), res.Chunks)
+		}
+
+		var indexes []int64
+		for k := range chunks {
+			indexes = append(indexes, k)
+		}
+		sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+		res.Body = nil
+		for _, e := range indexes {
+			res.Body = append(res.Body, chunks[e]...)
+		}
+	}
+
+	if err := res.Decompress(); err != nil {
+		return nil, errors.Wrapf(err, "*** Decompress response")
+	}
+	return res, nil
+}
+
+func purgeRequests(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("requests purge", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "", "Name of the endpoint. All endpoints when empty")
+	olderThan := fs.Duration("older-than", time.Minute*10, "Delete requests older than this")
+	fs.Parse(args)
+
+	endpoints := []string{*endpoint}
+	if *endpoint == "" {
+		names, err := forward.EndpointNames(ctx, client)
+		if err != nil {
+			return err
+		}
+		endpoints = names
+	}
+
+	before := time.Now().Add(-*olderThan)
+	for _, e := range endpoints {
+		n, err := forward.PurgeRequests(ctx, client, e, before)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Purged endpoint=%s, requests=%d", e, n)
+	}
+	return nil
+}
+
+func sweepRequests(ctx context.Context, client *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("requests sweep", flag.ExitOnError)
+	expire := fs.Duration("expire", time.Minute*10, "Delete requests older than this")
+	dryRun := fs.Bool("dry-run", false, "Only report documents to be deleted")
+	fs.Parse(args)
+
+	sweeper := &forward.Sweeper{
+		Client: client,
+		Expire: *expire,
+		DryRun: *dryRun,
+	}
+	report, err := sweeper.Sweep(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Requests without response:\t%d\n", report.Requests)
+	fmt.Fprintf(w, "Requests with response:\t%d\n", report.Responses)
+	fmt.Fprintf(w, "Chunks of requests:\t%d\n", report.Chunks)
+	fmt.Fprintf(w, "Orphaned chunks:\t%d\n", report.OrphanedChunks)
+	fmt.Fprintf(w, "Old quota documents:\t%d\n", report.Quotas)
+	if *dryRun {
+		fmt.Fprintln(w, "(dry-run, nothing is deleted)")
+	}
+	return w.Flush()
+}
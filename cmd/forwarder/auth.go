@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	forward "github.com/tckz/personal-forward"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator authenticates the request.
+type Authenticator interface {
+	Authenticate(r *http.Request) error
+	// Challenge is the value of WWW-Authenticate header.
+	Challenge() string
+}
+
+// NewAuthenticator creates Authenticator from policy.
+//
+//	none                                 No authentication.
+//	bearer:token1,token2                 Static bearer tokens.
+//	basic:user1:bcrypthash,user2:hash    Basic auth with bcrypt hashes.
+//	jwt:/path/or/URL/of/jwks.json[;iss=issuer][;aud=audience][;exp=optional]
+func NewAuthenticator(policy string) (Authenticator, error) {
+	if policy == "none" {
+		return nil, nil
+	}
+
+	kv := strings.SplitN(policy, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return nil, fmt.Errorf("policy must be 'kind:params': %s", policy)
+	}
+
+	switch kv[0] {
+	case "bearer":
+		return &BearerAuthenticator{Tokens: strings.Split(kv[1], ",")}, nil
+	case "basic":
+		users := map[string][]byte{}
+		for _, e := range strings.Split(kv[1], ",") {
+			up := strings.SplitN(e, ":", 2)
+			if len(up) != 2 {
+				return nil, fmt.Errorf("basic must be 'user:bcrypthash': %s", e)
+			}
+			if _, err := bcrypt.Cost([]byte(up[1])); err != nil {
+				return nil, fmt.Errorf("invalid bcrypt hash of %s: %v", up[0], err)
+			}
+			users[up[0]] = []byte(up[1])
+		}
+		return &BasicAuthenticator{Users: users}, nil
+	case "jwt":
+		params := strings.Split(kv[1], ";")
+		jwks, err := NewJWKS(params[0])
+		if err != nil {
+			return nil, err
+		}
+		v := &JWTVerifier{
+			JWKS:   jwks,
+			Leeway: time.Minute,
+		}
+		for _, e := range params[1:] {
+			opt := strings.SplitN(e, "=", 2)
+			if len(opt) != 2 {
+				return nil, fmt.Errorf("jwt option must be 'name=value': %s", e)
+			}
+			switch opt[0] {
+			case "iss":
+				v.Issuer = opt[1]
+			case "aud":
+				v.Audience = opt[1]
+			case "exp":
+				if opt[1] != "optional" {
+					return nil, fmt.Errorf("jwt option exp must be 'optional': %s", opt[1])
+				}
+				v.AllowNoExp = true
+			default:
+				return nil, fmt.Errorf("unknown jwt option: %s", opt[0])
+			}
+		}
+		return &JWTAuthenticator{Verifier: v}, nil
+	}
+
+	return nil, fmt.Errorf("unknown policy: %s", kv[0])
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > len("bearer ") && strings.EqualFold(h[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(h[len("bearer "):])
+	}
+	return ""
+}
+
+// BearerAuthenticator accepts one of the static tokens.
+type BearerAuthenticator struct {
+	Tokens []string
+}
+
+func (a *BearerAuthenticator) Authenticate(r *http.Request) error {
+	token := bearerToken(r)
+	if token == "" {
+		return fmt.Errorf("bearer token is missing")
+	}
+	for _, e := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(e)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("bearer token mismatch")
+}
+
+func (a *BearerAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// BasicAuthenticator accepts basic auth with bcrypt hashed password.
+type BasicAuthenticator struct {
+	Users map[string][]byte
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) error {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return fmt.Errorf("basic auth is missing")
+	}
+	hash, ok := a.Users[user]
+	if !ok {
+		return fmt.Errorf("unknown user: %s", user)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(pass)); err != nil {
+		return fmt.Errorf("password mismatch: %s", user)
+	}
+	return nil
+}
+
+func (a *BasicAuthenticator) Challenge() string {
+	return `Basic realm="` + myName + `"`
+}
+
+// JWTAuthenticator accepts JWT in bearer token.
+type JWTAuthenticator struct {
+	Verifier *JWTVerifier
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) error {
+	token := bearerToken(r)
+	if token == "" {
+		return fmt.Errorf("bearer token is missing")
+	}
+	return a.Verifier.Verify(token)
+}
+
+func (a *JWTAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// NewAuthMiddleware creates middleware which rejects unauthenticated request.
+// policies are "prefix=policy" separated by white spaces. See NewAuthenticator for policy.
+func NewAuthMiddleware(policies string, errorPages *ErrorResponder) (func(http.Handler) http.Handler, error) {
+	parsed, err := parsePrefixRules(policies)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticators := map[string]Authenticator{}
+	for _, e := range parsed {
+		a, err := NewAuthenticator(e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Prefix, err)
+		}
+		authenticators[e.Prefix] = a
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rule, ok := parsed.Match(r.URL.Path)
+			if !ok || authenticators[rule.Prefix] == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			a := authenticators[rule.Prefix]
+			if err := a.Authenticate(r); err != nil {
+				forward.ExtractLogger(r.Context()).Sugar().Warnf("Unauthorized: prefix=%s, %v", rule.Prefix, err)
+				w.Header().Set("WWW-Authenticate", a.Challenge())
+				errorPages.Respond(w, r, http.StatusUnauthorized, ErrorUnauthorized, err)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
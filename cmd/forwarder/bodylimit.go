@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	forward "github.com/tckz/personal-forward"
+)
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// limitedBody reports errRequestTooLarge when the body exceeds the limit.
+type limitedBody struct {
+	io.ReadCloser
+	read  int64
+	limit int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		err = errRequestTooLarge
+	}
+	return n, err
+}
+
+// readBody reads whole body of the request.
+// When it fails, it responds 413 or 500 and returns false.
+func readBody(w http.ResponseWriter, r *http.Request, errorPages *ErrorResponder) ([]byte, bool) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger := forward.ExtractLogger(r.Context()).Sugar()
+		if err == errRequestTooLarge {
+			logger.Warnf("Request body too large")
+			errorPages.Respond(w, r, http.StatusRequestEntityTooLarge, ErrorRequestTooLarge, err)
+		} else {
+			logger.Errorf("*** ReadAll: %v", err)
+			errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
+		}
+		return nil, false
+	}
+	return b, true
+}
+
+// NewBodyLimitMiddleware creates middleware which rejects the request whose body is larger than the limit.
+// rules are "prefix=bytes" separated by white spaces which override maxBytes.
+func NewBodyLimitMiddleware(maxBytes int64, rules string, errorPages *ErrorResponder) (func(http.Handler) http.Handler, error) {
+	parsed, err := parsePrefixRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := map[string]int64{}
+	for _, e := range parsed {
+		n, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		limits[e.Prefix] = n
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := maxBytes
+			if rule, ok := parsed.Match(r.URL.Path); ok {
+				limit = limits[rule.Prefix]
+			}
+			if limit <= 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if r.ContentLength > limit {
+				err := fmt.Errorf("Content-Length too large: %d > %d", r.ContentLength, limit)
+				forward.ExtractLogger(r.Context()).Sugar().Warnf("%v", err)
+				errorPages.Respond(w, r, http.StatusRequestEntityTooLarge, ErrorRequestTooLarge, err)
+				return
+			}
+
+			r.Body = &limitedBody{
+				ReadCloser: http.MaxBytesReader(w, r.Body, limit),
+				limit:      limit,
+			}
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	errorPages, err := NewErrorResponder("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, err := NewBodyLimitMiddleware(100, "/small=10 /free=0", errorPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := readBody(w, r, errorPages); !ok {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		uri  string
+		size int
+		want int
+	}{
+		{"/small", 10, http.StatusOK},
+		{"/small", 11, http.StatusRequestEntityTooLarge},
+		{"/small/x", 11, http.StatusRequestEntityTooLarge},
+		// Dot-segments and duplicated slashes must not escape the per-prefix limit.
+		{"/./small", 11, http.StatusRequestEntityTooLarge},
+		{"/x/../small/y", 11, http.StatusRequestEntityTooLarge},
+		{"//small", 11, http.StatusRequestEntityTooLarge},
+		{"/smaller", 11, http.StatusOK},
+		{"/other", 100, http.StatusOK},
+		{"/other", 101, http.StatusRequestEntityTooLarge},
+		{"/free", 1000, http.StatusOK},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tc.uri, strings.NewReader(strings.Repeat("x", tc.size)))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("size=%d: got %d, want %d", tc.size, w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestBodyLimitMiddlewareChunked(t *testing.T) {
+	errorPages, err := NewErrorResponder("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, err := NewBodyLimitMiddleware(0, "/small=10", errorPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := readBody(w, r, errorPages); !ok {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Content-Length is unknown, so that the limit is applied while reading.
+	r := httptest.NewRequest(http.MethodPost, "/./small", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 11))))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d", w.Code)
+	}
+}
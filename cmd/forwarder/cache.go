@@ -0,0 +1,385 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	forward "github.com/tckz/personal-forward"
+)
+
+// Results of cache lookup which are written to X-Cache header and metrics.
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheRevalidated = "REVALIDATED"
+)
+
+// cacheableStatus is status codes which are cacheable by default. RFC 7231 6.1
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// CacheEntry is the response stored in ResponseCache.
+type CacheEntry struct {
+	Key        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Stored is when the response was received or revalidated.
+	Stored time.Time
+	// Expires is when the response becomes stale. It is same as Stored when the response must be revalidated.
+	Expires time.Time
+	// Vary is values of request headers listed in Vary header of the response.
+	Vary map[string]string
+
+	elem *list.Element
+}
+
+func (e *CacheEntry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for k, values := range e.Header {
+		for _, v := range values {
+			n += len(k) + len(v)
+		}
+	}
+	return int64(n)
+}
+
+// Fresh reports whether the entry can be served without revalidation.
+func (e *CacheEntry) Fresh(r *http.Request, now time.Time) bool {
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok || r.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	if v, ok := cc["max-age"]; ok {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil && e.age(now) > time.Duration(sec)*time.Second {
+			return false
+		}
+	}
+	return now.Before(e.Expires)
+}
+
+func (e *CacheEntry) age(now time.Time) time.Duration {
+	age := now.Sub(e.Stored)
+	if sec, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil {
+		age += time.Duration(sec) * time.Second
+	}
+	return age
+}
+
+// AddValidators adds conditional headers to revalidate the entry.
+// It returns false when the entry has no validator.
+func (e *CacheEntry) AddValidators(h http.Header) bool {
+	added := false
+	if etag := e.Header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+		added = true
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		h.Set("If-Modified-Since", lm)
+		added = true
+	}
+	return added
+}
+
+// notModified reports whether the conditional request matches the entry.
+func (e *CacheEntry) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lm.After(ims)
+}
+
+// ResponseCache caches responses of GET and HEAD in memory with LRU.
+// It honors Cache-Control, Expires, ETag, Last-Modified and Vary of relayed responses.
+type ResponseCache struct {
+	// MaxBytes is the total size of entries. Least recently used entries are evicted over this.
+	MaxBytes int64
+	// MaxEntryBytes is the max size of an entry. Larger responses are not cached.
+	MaxEntryBytes int64
+	// KeyHeaders is request headers which are part of the key in addition to method and URI.
+	KeyHeaders []string
+
+	mu      sync.Mutex
+	entries map[string]*CacheEntry
+	lru     *list.List
+	size    int64
+}
+
+// NewResponseCache creates ResponseCache.
+// keyHeaders is header names separated by white spaces or commas.
+func NewResponseCache(maxBytes, maxEntryBytes int64, keyHeaders string) *ResponseCache {
+	c := &ResponseCache{
+		MaxBytes:      maxBytes,
+		MaxEntryBytes: maxEntryBytes,
+		entries:       map[string]*CacheEntry{},
+		lru:           list.New(),
+	}
+	for _, e := range splitList(keyHeaders) {
+		c.KeyHeaders = append(c.KeyHeaders, http.CanonicalHeaderKey(e))
+	}
+	return c
+}
+
+// Cacheable reports whether the request can be answered from the cache.
+func (c *ResponseCache) Cacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	_, noStore := parseCacheControl(r.Header.Get("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+// Key returns the key of the request. uri is the relayed URI.
+func (c *ResponseCache) Key(endpoint string, r *http.Request, uri string) string {
+	b := &strings.Builder{}
+	b.WriteString(endpoint + " " + r.Method + " " + uri)
+	for _, e := range c.KeyHeaders {
+		b.WriteString("\n" + e + ": " + strings.Join(r.Header[e], ", "))
+	}
+	return b.String()
+}
+
+// Get returns the entry for the request. nil when no entry matches.
+func (c *ResponseCache) Get(key string, r *http.Request) *CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	for k, v := range e.Vary {
+		if strings.Join(r.Header[k], ", ") != v {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(e.elem)
+	return e
+}
+
+// Store caches the response when it is cacheable, and returns the entry. It returns nil when not cached.
+func (c *ResponseCache) Store(key string, r *http.Request, res *forward.ResponsePayload, now time.Time) *CacheEntry {
+	if !cacheableStatus[res.StatusCode] || res.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	cc := parseCacheControl(res.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+	if r.Header.Get("Authorization") != "" {
+		// Shared cache must not reuse authorized responses unless it is explicitly allowed. RFC 7234 3.2
+		_, public := cc["public"]
+		_, sMaxAge := cc["s-maxage"]
+		_, mustRevalidate := cc["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return nil
+		}
+	}
+
+	e := &CacheEntry{
+		Key:        key,
+		StatusCode: res.StatusCode,
+		Header:     cloneHeader(res.Header),
+		Body:       res.Body,
+		Stored:     now,
+		Vary:       map[string]string{},
+	}
+	// The request ID belongs to the request which stored the response.
+	e.Header.Del(forward.RequestIDHeader)
+	e.Expires = now.Add(freshness(cc, res.Header))
+	if !e.Expires.After(now) && e.Header.Get("ETag") == "" && e.Header.Get("Last-Modified") == "" {
+		// Neither fresh nor revalidatable.
+		return nil
+	}
+
+	for _, v := range res.Header["Vary"] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if k == "*" {
+				return nil
+			}
+			if k != "" {
+				e.Vary[k] = strings.Join(r.Header[k], ", ")
+			}
+		}
+	}
+
+	if e.size() > c.MaxEntryBytes || e.size() > c.MaxBytes {
+		return nil
+	}
+	c.put(e)
+	return e
+}
+
+// Refresh updates the entry with the header of 304 response and returns the new entry.
+func (c *ResponseCache) Refresh(e *CacheEntry, h http.Header, now time.Time) *CacheEntry {
+	ne := *e
+	ne.elem = nil
+	ne.Header = cloneHeader(e.Header)
+	for k, values := range h {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Content-Type", "Transfer-Encoding":
+			// 304 has no body, these must not override the stored ones.
+			continue
+		case forward.RequestIDHeader:
+			continue
+		case "Etag":
+			// The stored body is compressed by the forwarder. Its validator stays weak.
+			if etag := e.Header.Get("ETag"); strings.HasPrefix(etag, "W/") && len(values) > 0 && !strings.HasPrefix(values[0], "W/") {
+				ne.Header[k] = []string{"W/" + values[0]}
+				continue
+			}
+		}
+		ne.Header[k] = values
+	}
+	ne.Stored = now
+	ne.Expires = now.Add(freshness(parseCacheControl(ne.Header.Get("Cache-Control")), ne.Header))
+	c.put(&ne)
+	return &ne
+}
+
+func (c *ResponseCache) put(e *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[e.Key]; ok {
+		c.lru.Remove(old.elem)
+		c.size -= old.size()
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.Key] = e
+	c.size += e.size()
+
+	for c.size > c.MaxBytes {
+		last := c.lru.Back().Value.(*CacheEntry)
+		c.lru.Remove(last.elem)
+		delete(c.entries, last.Key)
+		c.size -= last.size()
+	}
+}
+
+// Serve writes the entry as the response, or 304 when the conditional request matches it.
+func (c *ResponseCache) Serve(w http.ResponseWriter, r *http.Request, e *CacheEntry, result string, now time.Time) {
+	h := w.Header()
+	h.Set("X-Cache", result)
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+
+	if e.StatusCode == http.StatusOK && e.notModified(r) {
+		// RFC 7232 4.1
+		for _, k := range []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+			if v, ok := e.Header[http.CanonicalHeaderKey(k)]; ok {
+				h[k] = v
+			}
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	for k, values := range e.Header {
+		if k == "Age" {
+			continue
+		}
+		h[k] = values
+	}
+	w.WriteHeader(e.StatusCode)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// freshness returns the lifetime of the response. Zero means it must be revalidated.
+func freshness(cc map[string]string, h http.Header) time.Duration {
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	for _, k := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[k]; ok {
+			sec, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || sec < 0 {
+				return 0
+			}
+			return time.Duration(sec) * time.Second
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if d := exp.Sub(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// parseCacheControl parses directives of Cache-Control. Names are lower case.
+func parseCacheControl(v string) map[string]string {
+	ret := map[string]string{}
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		kv := strings.SplitN(e, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			ret[name] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		} else {
+			ret[name] = ""
+		}
+	}
+	return ret
+}
+
+// hasConditional reports whether the request has conditional headers of its own.
+func hasConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+func cloneHeader(h http.Header) http.Header {
+	ret := make(http.Header, len(h))
+	for k, values := range h {
+		ret[k] = append([]string(nil), values...)
+	}
+	return ret
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	forward "github.com/tckz/personal-forward"
+)
+
+func newCacheRequest(method string, header ...string) *http.Request {
+	r := httptest.NewRequest(method, "/x", nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Add(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	c := NewResponseCache(1000, 1000, "accept-encoding, X-Tenant")
+	base := c.Key("ep", newCacheRequest("GET", "Accept-Encoding", "gzip"), "/x")
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		r        *http.Request
+		uri      string
+		same     bool
+	}{
+		{"same", "ep", newCacheRequest("GET", "Accept-Encoding", "gzip"), "/x", true},
+		{"other header", "ep", newCacheRequest("GET", "Accept-Encoding", "gzip", "Accept", "text/html"), "/x", true},
+		{"endpoint", "other", newCacheRequest("GET", "Accept-Encoding", "gzip"), "/x", false},
+		{"method", "ep", newCacheRequest("HEAD", "Accept-Encoding", "gzip"), "/x", false},
+		{"uri", "ep", newCacheRequest("GET", "Accept-Encoding", "gzip"), "/x?a=1", false},
+		{"key header", "ep", newCacheRequest("GET", "Accept-Encoding", "br"), "/x", false},
+		{"missing key header", "ep", newCacheRequest("GET"), "/x", false},
+		{"additional key header", "ep", newCacheRequest("GET", "Accept-Encoding", "gzip", "X-Tenant", "a"), "/x", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := c.Key(tc.endpoint, tc.r, tc.uri) == base; got != tc.same {
+				t.Errorf("same=%t", got)
+			}
+		})
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	now := time.Now()
+	c := NewResponseCache(10000, 10000, "")
+	stored := newCacheRequest("GET", "Accept-Language", "ja", "Accept", "text/html")
+	key := c.Key("ep", stored, "/x")
+	e := c.Store(key, stored, &forward.ResponsePayload{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Vary":          {"accept-language, Accept", "X-Missing"},
+		},
+		Body: []byte("body"),
+	}, now)
+	if e == nil {
+		t.Fatal("must be stored")
+	}
+
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		hit  bool
+	}{
+		{"same", newCacheRequest("GET", "Accept-Language", "ja", "Accept", "text/html"), true},
+		{"other header", newCacheRequest("GET", "Accept-Language", "ja", "Accept", "text/html", "User-Agent", "x"), true},
+		{"language", newCacheRequest("GET", "Accept-Language", "en", "Accept", "text/html"), false},
+		{"missing", newCacheRequest("GET", "Accept", "text/html"), false},
+		{"header which was missing", newCacheRequest("GET", "Accept-Language", "ja", "Accept", "text/html", "X-Missing", "1"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := c.Get(key, tc.r) != nil; got != tc.hit {
+				t.Errorf("hit=%t", got)
+			}
+		})
+	}
+}
+
+func TestResponseCacheStore(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		r      *http.Request
+		status int
+		header http.Header
+		stored bool
+	}{
+		{"max-age", newCacheRequest("GET"), http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"expires", newCacheRequest("GET"), http.StatusOK, http.Header{
+			"Date":    {now.UTC().Format(http.TimeFormat)},
+			"Expires": {now.Add(time.Minute).UTC().Format(http.TimeFormat)},
+		}, true},
+		{"revalidatable", newCacheRequest("GET"), http.StatusOK, http.Header{"Etag": {`"a"`}}, true},
+		{"not fresh", newCacheRequest("GET"), http.StatusOK, http.Header{}, false},
+		{"no-store", newCacheRequest("GET"), http.StatusOK, http.Header{"Cache-Control": {"no-store, max-age=60"}}, false},
+		{"private", newCacheRequest("GET"), http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"set-cookie", newCacheRequest("GET"), http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, false},
+		{"status", newCacheRequest("GET"), http.StatusInternalServerError, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"not found", newCacheRequest("GET"), http.StatusNotFound, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"vary *", newCacheRequest("GET"), http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false},
+		{"authorized", newCacheRequest("GET", "Authorization", "Bearer x"), http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"authorized public", newCacheRequest("GET", "Authorization", "Bearer x"), http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"too large", newCacheRequest("GET"), http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "X-Large": {strings.Repeat("x", 200)}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewResponseCache(1000, 200, "")
+			e := c.Store("k", tc.r, &forward.ResponsePayload{StatusCode: tc.status, Header: tc.header, Body: []byte("body")}, now)
+			if (e != nil) != tc.stored {
+				t.Errorf("stored=%t", e != nil)
+			}
+		})
+	}
+}
+
+func TestResponseCacheStoreRemovesRequestID(t *testing.T) {
+	c := NewResponseCache(1000, 1000, "")
+	e := c.Store("k", newCacheRequest("GET"), &forward.ResponsePayload{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": {"max-age=60"}, forward.RequestIDHeader: {"abc"}},
+	}, time.Now())
+	if e == nil {
+		t.Fatal("must be stored")
+	}
+	if _, ok := e.Header[forward.RequestIDHeader]; ok {
+		t.Errorf("request ID must not be stored")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	now := time.Now()
+	res := &forward.ResponsePayload{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": {"max-age=60"}},
+		Body:       []byte(strings.Repeat("x", 40)),
+	}
+	r := newCacheRequest("GET")
+	// About 3 entries fit.
+	c := NewResponseCache(200, 200, "")
+	for _, k := range []string{"a", "b", "c"} {
+		c.Store(k, r, res, now)
+	}
+	c.Get("a", r)
+	c.Store("d", r, res, now)
+
+	for _, tc := range []struct {
+		key string
+		hit bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+		{"d", true},
+	} {
+		if got := c.Get(tc.key, r) != nil; got != tc.hit {
+			t.Errorf("%s: hit=%t", tc.key, got)
+		}
+	}
+	if c.size > c.MaxBytes {
+		t.Errorf("size=%d", c.size)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Now().UTC()
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, time.Minute * 2},
+		{"quoted", http.Header{"Cache-Control": {`max-age="30"`}}, time.Second * 30},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0},
+		{"invalid", http.Header{"Cache-Control": {"max-age=x"}}, 0},
+		{"negative", http.Header{"Cache-Control": {"max-age=-1"}}, 0},
+		{"expires", http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, time.Hour},
+		{"max-age wins expires", http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Date":          {now.Format(http.TimeFormat)},
+			"Expires":       {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, time.Minute},
+		{"expired", http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(-time.Hour).Format(http.TimeFormat)},
+		}, 0},
+		{"invalid expires", http.Header{"Expires": {"0"}}, 0},
+		{"none", http.Header{}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := freshness(parseCacheControl(tc.header.Get("Cache-Control")), tc.header); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCacheEntryFresh(t *testing.T) {
+	now := time.Now()
+	e := &CacheEntry{Header: http.Header{}, Stored: now.Add(-time.Second * 30), Expires: now.Add(time.Second * 30)}
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"fresh", newCacheRequest("GET"), true},
+		{"no-cache", newCacheRequest("GET", "Cache-Control", "no-cache"), false},
+		{"pragma", newCacheRequest("GET", "Pragma", "no-cache"), false},
+		{"max-age of the request", newCacheRequest("GET", "Cache-Control", "max-age=10"), false},
+		{"max-age of the request satisfied", newCacheRequest("GET", "Cache-Control", "max-age=60"), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := e.Fresh(tc.r, now); got != tc.want {
+				t.Errorf("got %t", got)
+			}
+		})
+	}
+	if e.Fresh(newCacheRequest("GET"), now.Add(time.Minute)) {
+		t.Errorf("must be stale after Expires")
+	}
+}
+
+func TestResponseCacheServe(t *testing.T) {
+	now := time.Now()
+	lm := now.Add(-time.Hour).UTC().Format(http.TimeFormat)
+	e := &CacheEntry{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Etag":           {`W/"v1"`},
+			"Last-Modified":  {lm},
+			"Content-Type":   {"text/plain"},
+			"Content-Length": {"4"},
+		},
+		Body:   []byte("body"),
+		Stored: now.Add(-time.Second * 10),
+	}
+	c := NewResponseCache(1000, 1000, "")
+
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		want int
+		body string
+	}{
+		{"get", newCacheRequest("GET"), http.StatusOK, "body"},
+		{"head", newCacheRequest("HEAD"), http.StatusOK, ""},
+		{"if-none-match", newCacheRequest("GET", "If-None-Match", `"v1"`), http.StatusNotModified, ""},
+		{"if-none-match weak", newCacheRequest("GET", "If-None-Match", `"v0", W/"v1"`), http.StatusNotModified, ""},
+		{"if-none-match *", newCacheRequest("GET", "If-None-Match", `*`), http.StatusNotModified, ""},
+		{"if-none-match mismatch", newCacheRequest("GET", "If-None-Match", `"v2"`), http.StatusOK, "body"},
+		// If-None-Match wins If-Modified-Since.
+		{"if-none-match mismatch with ims", newCacheRequest("GET", "If-None-Match", `"v2"`, "If-Modified-Since", lm), http.StatusOK, "body"},
+		{"if-modified-since", newCacheRequest("GET", "If-Modified-Since", lm), http.StatusNotModified, ""},
+		{"modified", newCacheRequest("GET", "If-Modified-Since", now.Add(-time.Hour*2).UTC().Format(http.TimeFormat)), http.StatusOK, "body"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c.Serve(w, tc.r, e, CacheHit, now)
+			if w.Code != tc.want || w.Body.String() != tc.body {
+				t.Errorf("got %d %q", w.Code, w.Body.String())
+			}
+			if w.Header().Get("X-Cache") != CacheHit || w.Header().Get("Age") != "10" {
+				t.Errorf("X-Cache=%s, Age=%s", w.Header().Get("X-Cache"), w.Header().Get("Age"))
+			}
+		})
+	}
+}
+
+func TestResponseCacheRefresh(t *testing.T) {
+	now := time.Now()
+	c := NewResponseCache(1000, 1000, "")
+	e := c.Store("k", newCacheRequest("GET"), &forward.ResponsePayload{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Etag":             {`W/"v1"`},
+			"Content-Encoding": {"gzip"},
+			"Cache-Control":    {"max-age=0"},
+		},
+		Body: []byte("body"),
+	}, now.Add(-time.Minute))
+	if e == nil {
+		t.Fatal("must be stored")
+	}
+
+	ne := c.Refresh(e, http.Header{
+		"Etag":                  {`"v1"`},
+		"Cache-Control":         {"max-age=60"},
+		"Content-Length":        {"0"},
+		forward.RequestIDHeader: {"abc"},
+	}, now)
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"Etag", `W/"v1"`},
+		{"Content-Encoding", "gzip"},
+		{"Content-Length", ""},
+		{"Cache-Control", "max-age=60"},
+		{forward.RequestIDHeader, ""},
+	} {
+		if got := ne.Header.Get(tc.name); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+	if !ne.Fresh(newCacheRequest("GET"), now) {
+		t.Errorf("refreshed entry must be fresh")
+	}
+	if c.Get("k", newCacheRequest("GET")) != ne {
+		t.Errorf("refreshed entry must replace the old one")
+	}
+}
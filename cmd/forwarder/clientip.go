@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPResolver determines IP address of the client.
+// Headers which the client can forge are trusted only when they are set by known frontends.
+type ClientIPResolver struct {
+	// AppEngine trusts X-Appengine-User-Ip, which the frontend of GAE overwrites.
+	AppEngine bool
+	// TrustedProxies is proxies in front of the forwarder.
+	// X-Forwarded-For is used only when the request comes through them.
+	TrustedProxies IPList
+}
+
+// ClientIP returns IP address of the client.
+// Under GAE, X-Appengine-User-Ip is used.
+// When the remote address is a trusted proxy, the right-most address of X-Forwarded-For which is not a trusted proxy is used.
+// Otherwise the remote address is used.
+func (c *ClientIPResolver) ClientIP(r *http.Request) net.IP {
+	if c.AppEngine {
+		if v := r.Header.Get("X-Appengine-User-Ip"); v != "" {
+			if ip := net.ParseIP(strings.TrimSpace(v)); ip != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !c.TrustedProxies.Contains(ip) {
+		return ip
+	}
+
+	// Each proxy appends the address which it received from, so that the left part can be forged by the client.
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Beyond this is not reliable.
+			break
+		}
+		ip = hop
+		if !c.TrustedProxies.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustLoadIPList(t *testing.T, s string) IPList {
+	t.Helper()
+	l, err := (&IPListLoader{}).Load(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := mustLoadIPList(t, "10.0.0.0/8 2001:db8::/32")
+
+	for _, tc := range []struct {
+		name      string
+		appEngine bool
+		remote    string
+		xff       []string
+		gae       string
+		want      string
+	}{
+		{"remote", false, "192.0.2.1:1234", nil, "", "192.0.2.1"},
+		{"remote without port", false, "192.0.2.1", nil, "", "192.0.2.1"},
+		{"ipv6", false, "[2001:db9::1]:1234", nil, "", "2001:db9::1"},
+		{"untrusted xff", false, "192.0.2.1:1234", []string{"198.51.100.1"}, "", "192.0.2.1"},
+		{"trusted xff", false, "10.0.0.1:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"forged left part", false, "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1"}, "", "198.51.100.1"},
+		{"chained proxies", false, "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "", "198.51.100.1"},
+		{"multiple headers", false, "10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.1, 10.0.0.2"}, "", "198.51.100.1"},
+		{"ipv6 proxy", false, "[2001:db8::1]:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"invalid hop", false, "10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, "", "10.0.0.2"},
+		{"only proxies", false, "10.0.0.1:1234", []string{"10.0.0.2"}, "", "10.0.0.2"},
+		{"no xff from proxy", false, "10.0.0.1:1234", nil, "", "10.0.0.1"},
+		{"gae", true, "10.0.0.1:1234", []string{"203.0.113.9"}, "198.51.100.1", "198.51.100.1"},
+		{"gae header ignored", false, "192.0.2.1:1234", nil, "198.51.100.1", "192.0.2.1"},
+		{"gae invalid header", true, "192.0.2.1:1234", nil, "garbage", "192.0.2.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			for _, e := range tc.xff {
+				r.Header.Add("X-Forwarded-For", e)
+			}
+			if tc.gae != "" {
+				r.Header.Set("X-Appengine-User-Ip", tc.gae)
+			}
+			c := &ClientIPResolver{AppEngine: tc.appEngine, TrustedProxies: proxies}
+			if got := c.ClientIP(r); !got.Equal(net.ParseIP(tc.want)) {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIPListLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iplist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	presets := filepath.Join(dir, "presets.json")
+	if err := ioutil.WriteFile(presets, []byte(`{"hooks":["192.0.2.0/24","2001:db8::/32"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(dir, "list.txt")
+	if err := ioutil.WriteFile(list, []byte("# comment\n198.51.100.1\n\n203.0.113.0/28\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		spec    string
+		ok      bool
+		in, out []string
+	}{
+		{"192.0.2.0/24", true, []string{"192.0.2.1", "192.0.2.255"}, []string{"192.0.3.1"}},
+		{"192.0.2.1, 2001:db8::1", true, []string{"192.0.2.1", "2001:db8::1"}, []string{"192.0.2.2", "2001:db8::2"}},
+		{"preset:hooks", true, []string{"192.0.2.9", "2001:db8::9"}, []string{"198.51.100.1"}},
+		{"@" + list, true, []string{"198.51.100.1", "203.0.113.15"}, []string{"203.0.113.16"}},
+		{"preset:unknown", false, nil, nil},
+		{"@" + filepath.Join(dir, "none.txt"), false, nil, nil},
+		{"192.0.2.0/33", false, nil, nil},
+		{"example.com", false, nil, nil},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			l, err := (&IPListLoader{PresetsFile: presets}).Load(tc.spec)
+			if (err == nil) != tc.ok {
+				t.Fatalf("err=%v", err)
+			}
+			for _, e := range tc.in {
+				if !l.Contains(net.ParseIP(e)) {
+					t.Errorf("%s must be contained", e)
+				}
+			}
+			for _, e := range tc.out {
+				if l.Contains(net.ParseIP(e)) {
+					t.Errorf("%s must not be contained", e)
+				}
+			}
+		})
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	errorPages, err := NewErrorResponder("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &ClientIPResolver{TrustedProxies: mustLoadIPList(t, "10.0.0.0/8")}
+
+	for _, tc := range []struct {
+		name   string
+		allow  string
+		deny   string
+		remote string
+		xff    string
+		want   int
+	}{
+		{"allowed", "192.0.2.0/24", "", "192.0.2.1:1", "", http.StatusOK},
+		{"not allowed", "192.0.2.0/24", "", "198.51.100.1:1", "", http.StatusForbidden},
+		{"denied", "", "192.0.2.1", "192.0.2.1:1", "", http.StatusForbidden},
+		{"deny wins", "192.0.2.0/24", "192.0.2.1", "192.0.2.1:1", "", http.StatusForbidden},
+		{"no allow list", "", "192.0.2.1", "198.51.100.1:1", "", http.StatusOK},
+		{"via proxy", "192.0.2.0/24", "", "10.0.0.1:1", "192.0.2.1", http.StatusOK},
+		// X-Forwarded-For from the client itself is not trusted.
+		{"forged xff", "192.0.2.0/24", "", "198.51.100.1:1", "192.0.2.1", http.StatusForbidden},
+		{"invalid remote", "", "", "garbage", "", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewIPFilterMiddleware(mustLoadIPList(t, tc.allow), mustLoadIPList(t, tc.deny), resolver.ClientIP, errorPages)(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
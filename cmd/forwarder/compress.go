@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+)
+
+const encodingBrotli = "br"
+
+// ResponseCompressor compresses relayed responses according to Accept-Encoding of the client.
+type ResponseCompressor struct {
+	// Encodings is supported encodings in order of preference.
+	Encodings []string
+	// Types is patterns of media type which are compressed. e.g. text/*
+	Types []string
+	// MinBytes is the size of body which is compressed at least.
+	MinBytes int
+}
+
+// NewResponseCompressor creates ResponseCompressor.
+// encodings and types are separated by white spaces or commas.
+func NewResponseCompressor(encodings string, types string, minBytes int) (*ResponseCompressor, error) {
+	c := &ResponseCompressor{
+		Encodings: splitList(encodings),
+		Types:     splitList(types),
+		MinBytes:  minBytes,
+	}
+	for _, e := range c.Encodings {
+		switch e {
+		case forward.EncodingGzip, encodingBrotli:
+		default:
+			return nil, fmt.Errorf("unsupported encoding: %s", e)
+		}
+	}
+	for _, e := range c.Types {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, errors.Wrapf(err, "*** type pattern: %s", e)
+		}
+	}
+	return c, nil
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// compressible reports whether the response is worth compressing regardless of the client.
+func (c *ResponseCompressor) compressible(r *http.Request, res *forward.ResponsePayload) bool {
+	if r.Method == http.MethodHead || res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusNotModified || res.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	if ce := res.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(res.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	mt, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, e := range c.Types {
+		if ok, _ := path.Match(e, mt); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate chooses the encoding from Accept-Encoding. Empty means identity.
+func (c *ResponseCompressor) Negotiate(acceptEncoding string) string {
+	q := map[string]float64{}
+	for _, e := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(e, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q[coding] = 1
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				v, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					v = 0
+				}
+				q[coding] = v
+			}
+		}
+	}
+
+	for _, e := range c.Encodings {
+		if v, ok := q[e]; ok {
+			if v > 0 {
+				return e
+			}
+			continue
+		}
+		if v, ok := q["*"]; ok && v > 0 {
+			return e
+		}
+	}
+	return ""
+}
+
+// Apply compresses the body of res and fixes up its header.
+// It returns the encoding which is applied. Empty means the response is not changed.
+func (c *ResponseCompressor) Apply(r *http.Request, res *forward.ResponsePayload) (string, error) {
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	if !c.compressible(r, res) {
+		return "", nil
+	}
+	// The representation depends on Accept-Encoding even when it is not compressed.
+	addVary(res.Header, "Accept-Encoding")
+	if len(res.Body) < c.MinBytes {
+		return "", nil
+	}
+	enc := c.Negotiate(r.Header.Get("Accept-Encoding"))
+	if enc == "" {
+		return "", nil
+	}
+
+	buf := &bytes.Buffer{}
+	switch enc {
+	case encodingBrotli:
+		bw := brotli.NewWriter(buf)
+		if _, err := bw.Write(res.Body); err != nil {
+			return "", errors.Wrapf(err, "*** brotli.Write")
+		}
+		if err := bw.Close(); err != nil {
+			return "", errors.Wrapf(err, "*** brotli.Close")
+		}
+	default:
+		b, err := forward.Compress(enc, res.Body)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(b)
+	}
+
+	res.Body = buf.Bytes()
+	res.Header.Set("Content-Encoding", enc)
+	res.Header.Set("Content-Length", strconv.Itoa(len(res.Body)))
+	// Byte ranges of the upstream do not apply to the compressed body.
+	res.Header.Del("Accept-Ranges")
+	// The compressed body is not byte-for-byte same as the upstream's, so that the strong validator must be weak. RFC 7232 2.1
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+	return enc, nil
+}
+
+func addVary(h http.Header, name string) {
+	for _, v := range h["Vary"] {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e == "*" || strings.EqualFold(e, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
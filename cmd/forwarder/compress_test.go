@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	forward "github.com/tckz/personal-forward"
+)
+
+func TestResponseCompressorNegotiate(t *testing.T) {
+	c, err := NewResponseCompressor("br,gzip", "text/*", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"br;q=0.5, gzip;q=0.8", "br"},
+		{"*", "br"},
+		{"*;q=0", ""},
+		{"br;q=0, *", "gzip"},
+		{"gzip;q=0, *;q=0", ""},
+		{"identity", ""},
+		{"deflate", ""},
+		{"", ""},
+		{"br;q=x, gzip;q=0.1", "gzip"},
+	} {
+		if got := c.Negotiate(tc.accept); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestNewResponseCompressor(t *testing.T) {
+	for _, tc := range []struct {
+		encodings string
+		types     string
+		ok        bool
+	}{
+		{"br gzip", "text/* application/json", true},
+		{"", "", true},
+		{"deflate", "text/*", false},
+		{"gzip", "[", false},
+	} {
+		if _, err := NewResponseCompressor(tc.encodings, tc.types, 0); (err == nil) != tc.ok {
+			t.Errorf("%s %s: err=%v", tc.encodings, tc.types, err)
+		}
+	}
+}
+
+func TestResponseCompressorApply(t *testing.T) {
+	c, err := NewResponseCompressor("br gzip", "text/* application/json application/*+json", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("hello ", 100)
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		accept   string
+		status   int
+		header   http.Header
+		body     string
+		want     string
+		wantVary bool
+	}{
+		{"br", "GET", "gzip, br", 200, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, body, "br", true},
+		{"gzip", "GET", "gzip", 200, http.Header{"Content-Type": {"application/json"}}, body, "gzip", true},
+		{"suffix type", "GET", "gzip", 200, http.Header{"Content-Type": {"application/problem+json"}}, body, "gzip", true},
+		{"not accepted", "GET", "", 200, http.Header{"Content-Type": {"text/plain"}}, body, "", true},
+		{"small", "GET", "gzip", 200, http.Header{"Content-Type": {"text/plain"}}, "hello", "", true},
+		{"type", "GET", "gzip", 200, http.Header{"Content-Type": {"image/png"}}, body, "", false},
+		{"no type", "GET", "gzip", 200, http.Header{}, body, "", false},
+		{"encoded", "GET", "gzip", 200, http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}, body, "", false},
+		{"no-transform", "GET", "gzip", 200, http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"public, No-Transform"}}, body, "", false},
+		{"head", "HEAD", "gzip", 200, http.Header{"Content-Type": {"text/plain"}}, body, "", false},
+		{"partial", "GET", "gzip", 206, http.Header{"Content-Type": {"text/plain"}}, body, "", false},
+		{"no content", "GET", "gzip", 204, http.Header{"Content-Type": {"text/plain"}}, "", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/", nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept-Encoding", tc.accept)
+			}
+			res := &forward.ResponsePayload{StatusCode: tc.status, Header: tc.header, Body: []byte(tc.body)}
+			enc, err := c.Apply(r, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enc != tc.want {
+				t.Errorf("encoding=%q", enc)
+			}
+			if got := res.Header.Get("Vary") == "Accept-Encoding"; got != tc.wantVary {
+				t.Errorf("Vary=%v", res.Header["Vary"])
+			}
+			if enc == "" {
+				if string(res.Body) != tc.body {
+					t.Errorf("body must not be changed")
+				}
+				return
+			}
+
+			if res.Header.Get("Content-Encoding") != enc {
+				t.Errorf("Content-Encoding=%s", res.Header.Get("Content-Encoding"))
+			}
+			var b []byte
+			if enc == encodingBrotli {
+				b, err = ioutil.ReadAll(brotli.NewReader(bytes.NewReader(res.Body)))
+			} else {
+				b, err = forward.Decompress(enc, res.Body)
+			}
+			if err != nil || string(b) != tc.body {
+				t.Errorf("decompressed body mismatch: %v", err)
+			}
+		})
+	}
+}
+
+func TestResponseCompressorApplyHeader(t *testing.T) {
+	c, err := NewResponseCompressor("gzip", "text/*", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		header   http.Header
+		wantETag string
+		wantVary []string
+	}{
+		{"strong etag", http.Header{"Etag": {`"v1"`}}, `W/"v1"`, []string{"Accept-Encoding"}},
+		{"weak etag", http.Header{"Etag": {`W/"v1"`}}, `W/"v1"`, []string{"Accept-Encoding"}},
+		{"vary", http.Header{"Vary": {"Accept-Language"}}, "", []string{"Accept-Language", "Accept-Encoding"}},
+		{"vary already", http.Header{"Vary": {"accept-language, accept-encoding"}}, "", []string{"accept-language, accept-encoding"}},
+		{"vary *", http.Header{"Vary": {"*"}}, "", []string{"*"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			tc.header.Set("Content-Type", "text/plain")
+			tc.header.Set("Accept-Ranges", "bytes")
+			tc.header.Set("Content-Length", "5")
+			res := &forward.ResponsePayload{StatusCode: 200, Header: tc.header, Body: []byte("hello")}
+			if _, err := c.Apply(r, res); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := res.Header.Get("ETag"); got != tc.wantETag {
+				t.Errorf("ETag=%s", got)
+			}
+			if got := res.Header["Vary"]; strings.Join(got, "|") != strings.Join(tc.wantVary, "|") {
+				t.Errorf("Vary=%v", got)
+			}
+			if res.Header.Get("Accept-Ranges") != "" {
+				t.Errorf("Accept-Ranges must be removed")
+			}
+			if res.Header.Get("Content-Length") == "5" {
+				t.Errorf("Content-Length must be updated")
+			}
+		})
+	}
+}
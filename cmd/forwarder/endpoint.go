@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+)
+
+// EndpointRouter resolves the endpoint which the request is relayed to.
+type EndpointRouter struct {
+	// Default is used when no rule matches. It can be empty.
+	Default string
+	// PathPrefix enables "/{endpoint}/path" form. The first segment is removed from the relayed URI.
+	PathPrefix bool
+	// Registered restricts endpoints to the ones which are registered and enabled in Firestore.
+	Registered bool
+
+	mu sync.RWMutex
+	// hosts maps host name to endpoint name. "*.example.com" maps the first label of the host to endpoint name.
+	hosts map[string]string
+	// known is endpoint names which are allowed by PathPrefix and wildcard hosts.
+	known map[string]bool
+	// registryHosts and registry are loaded from Firestore.
+	registryHosts map[string]string
+	registry      map[string]bool
+}
+
+// NewEndpointRouter creates EndpointRouter.
+// hosts is "host=endpoint" separated by white spaces. Endpoint "*" of "*.example.com" means the first label of the host.
+// names is additional endpoint names separated by white spaces or commas, which are allowed by PathPrefix and wildcard hosts.
+func NewEndpointRouter(def string, hosts string, names string, pathPrefix bool) (*EndpointRouter, error) {
+	r := &EndpointRouter{
+		Default:    def,
+		PathPrefix: pathPrefix,
+		hosts:      map[string]string{},
+		known:      map[string]bool{},
+	}
+	if def != "" {
+		r.known[def] = true
+	}
+
+	for _, e := range strings.Fields(hosts) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("host rule must be 'host=endpoint': %s", e)
+		}
+		if kv[1] == "*" && !strings.HasPrefix(kv[0], "*.") {
+			return nil, fmt.Errorf("endpoint '*' is only for '*.domain': %s", e)
+		}
+		r.hosts[strings.ToLower(kv[0])] = kv[1]
+		if kv[1] != "*" {
+			r.known[kv[1]] = true
+		}
+	}
+
+	for _, e := range strings.FieldsFunc(names, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		r.known[e] = true
+	}
+
+	return r, nil
+}
+
+func (r *EndpointRouter) isKnown(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.known[name] || r.registry[name]
+}
+
+func (r *EndpointRouter) lookupHost(host string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if ep, ok := r.registryHosts[host]; ok {
+		return ep, true
+	}
+	if ep, ok := r.hosts[host]; ok {
+		return ep, true
+	}
+
+	// wildcard
+	if i := strings.Index(host, "."); i > 0 {
+		if ep, ok := r.hosts["*"+host[i:]]; ok {
+			if ep == "*" {
+				// Same as PathPrefix, the label must be a known endpoint.
+				// Otherwise the host is not routed even to Default.
+				label := host[:i]
+				if r.known[label] || r.registry[label] {
+					return label, true
+				}
+				return "", true
+			}
+			return ep, true
+		}
+	}
+	return "", false
+}
+
+// Resolve returns the endpoint name and the request URI which is relayed.
+func (r *EndpointRouter) Resolve(req *http.Request) (string, string, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if ep, ok := r.lookupHost(host); ok {
+		if ep == "" {
+			return "", "", false
+		}
+		return r.accept(ep, req.RequestURI)
+	}
+
+	if r.PathPrefix {
+		p := strings.TrimPrefix(req.RequestURI, "/")
+		seg := p
+		rest := "/"
+		if i := strings.IndexAny(p, "/?"); i >= 0 {
+			seg = p[:i]
+			rest = p[i:]
+			if !strings.HasPrefix(rest, "/") {
+				rest = "/" + rest
+			}
+		}
+		if seg != "" && r.isKnown(seg) {
+			return r.accept(seg, rest)
+		}
+	}
+
+	if r.Default != "" {
+		return r.accept(r.Default, req.RequestURI)
+	}
+	return "", "", false
+}
+
+func (r *EndpointRouter) accept(ep string, uri string) (string, string, bool) {
+	if r.Registered {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		if !r.registry[ep] {
+			return "", "", false
+		}
+	}
+	return ep, uri, true
+}
+
+// WatchRegistry listens "endpoints" collection of Firestore and registers the endpoints.
+// The document ID is the endpoint name and "hosts" field is array of host names of the endpoint.
+// The endpoint whose "enabled" field is not true is ignored.
+// When listening fails, it keeps the last registry and listens again with backoff until ctx is done.
+func (r *EndpointRouter) WatchRegistry(ctx context.Context, client *firestore.Client) {
+	const minBackoff, maxBackoff = time.Second, time.Minute
+	backoff := minBackoff
+	for {
+		err := r.watchRegistry(ctx, client, func() {
+			backoff = minBackoff
+		})
+		if err == nil {
+			return
+		}
+		metricRegistryUp.Set(0)
+		metricFirestoreErrors.WithLabelValues("watch_endpoints").Inc()
+		logger.With(zap.Error(err)).Errorf("*** Watch endpoints, retry after %s", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// watchRegistry listens the registry until it fails. It returns nil when ctx is done.
+// received is called every time the snapshot is applied.
+func (r *EndpointRouter) watchRegistry(ctx context.Context, client *firestore.Client, received func()) error {
+	it := client.Collection("endpoints").Snapshots(ctx)
+	defer it.Stop()
+
+	for {
+		snapshot, err := it.Next()
+		if err != nil {
+			if s, ok := err.(forward.GRPCStatusHolder); err == iterator.Done || ok && s.GRPCStatus().Code() == codes.Canceled {
+				return nil
+			}
+			return errors.Wrapf(err, "*** endpoints it.Next")
+		}
+
+		registry := map[string]bool{}
+		registryHosts := map[string]string{}
+		for {
+			doc, err := snapshot.Documents.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return errors.Wrapf(err, "*** endpoints Documents.Next")
+			}
+
+			if enabled, _ := doc.DataAt("enabled"); enabled != true {
+				continue
+			}
+			registry[doc.Ref.ID] = true
+			if hosts, err := doc.DataAt("hosts"); err == nil {
+				if list, ok := hosts.([]interface{}); ok {
+					for _, e := range list {
+						registryHosts[strings.ToLower(fmt.Sprint(e))] = doc.Ref.ID
+					}
+				}
+			}
+		}
+
+		r.mu.Lock()
+		r.registry = registry
+		r.registryHosts = registryHosts
+		r.mu.Unlock()
+		metricRegistryUp.Set(1)
+		received()
+		logger.Infof("Endpoint registry: endpoints=%d, hosts=%d", len(registry), len(registryHosts))
+	}
+}
+
+type contextKeyEndpointMarker struct{}
+
+var contextKeyEndpoint = &contextKeyEndpointMarker{}
+
+type resolvedEndpoint struct {
+	Name       string
+	RequestURI string
+}
+
+// extractEndpoint retrieves the endpoint resolved by NewEndpointMiddleware.
+func extractEndpoint(ctx context.Context) resolvedEndpoint {
+	if r, ok := ctx.Value(contextKeyEndpoint).(resolvedEndpoint); ok {
+		return r
+	}
+	return resolvedEndpoint{}
+}
+
+// NewEndpointMiddleware creates middleware which resolves the endpoint of the request.
+// The request which matches no endpoint is rejected with 404.
+func NewEndpointMiddleware(router *EndpointRouter, errorPages *ErrorResponder) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ep, uri, ok := router.Resolve(r)
+			if !ok {
+				forward.ExtractLogger(ctx).Sugar().Warnf("No endpoint: host=%s, uri=%s", r.Host, r.RequestURI)
+				errorPages.Respond(w, r, http.StatusNotFound, ErrorNoRoute, nil)
+				return
+			}
+
+			setMetricsLabel(ctx, ep)
+			ctx = forward.WithLogger(ctx, forward.ExtractLogger(ctx).With(zap.String("endpoint", ep)))
+			ctx = context.WithValue(ctx, contextKeyEndpoint, resolvedEndpoint{
+				Name:       ep,
+				RequestURI: uri,
+			})
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEndpointRouterResolve(t *testing.T) {
+	r, err := NewEndpointRouter("def", "alice.example.com=alice *.hook.example.com=* *.fixed.example.com=fixed", "bob carol", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.registry = map[string]bool{"dave": true}
+
+	for _, tc := range []struct {
+		host   string
+		uri    string
+		wantOK bool
+		wantEP string
+		// relayed URI
+		wantURI string
+	}{
+		{"alice.example.com", "/x", true, "alice", "/x"},
+		{"ALICE.example.com:443", "/x", true, "alice", "/x"},
+		{"bob.hook.example.com", "/x", true, "bob", "/x"},
+		{"dave.hook.example.com", "/x", true, "dave", "/x"},
+		// The label of the wildcard must be a known endpoint.
+		{"mallory.hook.example.com", "/x", false, "", ""},
+		{"mallory.hook.example.com", "/bob/x", false, "", ""},
+		{"any.fixed.example.com", "/x", true, "fixed", "/x"},
+		{"other.example.com", "/carol/x?a=1", true, "carol", "/x?a=1"},
+		{"other.example.com", "/carol?a=1", true, "carol", "/?a=1"},
+		{"other.example.com", "/mallory/x", true, "def", "/mallory/x"},
+	} {
+		t.Run(tc.host+tc.uri, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.uri, nil)
+			req.Host = tc.host
+			ep, uri, ok := r.Resolve(req)
+			if ok != tc.wantOK || ep != tc.wantEP || uri != tc.wantURI {
+				t.Errorf("got (%s, %s, %t)", ep, uri, ok)
+			}
+		})
+	}
+}
+
+func TestEndpointRouterRegistered(t *testing.T) {
+	r, err := NewEndpointRouter("", "*.hook.example.com=*", "bob", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Registered = true
+	r.registry = map[string]bool{"dave": true}
+
+	for _, tc := range []struct {
+		host   string
+		wantOK bool
+	}{
+		{"dave.hook.example.com", true},
+		// Known but not registered.
+		{"bob.hook.example.com", false},
+		{"mallory.hook.example.com", false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tc.host
+		if _, _, ok := r.Resolve(req); ok != tc.wantOK {
+			t.Errorf("%s: got %t", tc.host, ok)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+)
+
+// Categories of errors which are written to X-Forward-Error header.
+const (
+	ErrorNoRoute    = "no-route"
+	ErrorNoConsumer = "no-consumer"
+	ErrorTimeout    = "timeout"
+	ErrorUpstream   = "upstream-refused"
+	ErrorChunkLoss  = "chunk-loss"
+	ErrorInternal   = "internal"
+
+	ErrorForbiddenIP      = "forbidden-ip"
+	ErrorRateLimited      = "rate-limited"
+	ErrorQuotaExceeded    = "quota-exceeded"
+	ErrorQuotaUnavailable = "quota-unavailable"
+	ErrorRequestTooLarge  = "request-too-large"
+	ErrorUnauthorized     = "unauthorized"
+	ErrorInvalidSignature = "invalid-signature"
+	ErrorBadPath          = "bad-path"
+)
+
+var errorMessages = map[string]string{
+	ErrorNoRoute:    "No endpoint matches the request.",
+	ErrorNoConsumer: "No consumer picked up the request in time.",
+	ErrorTimeout:    "The consumer did not respond in time.",
+	ErrorUpstream:   "The consumer failed to forward the request to the upstream.",
+	ErrorChunkLoss:  "Chunks of the response body were lost.",
+	ErrorInternal:   "Internal error of the forwarder.",
+
+	ErrorForbiddenIP:      "The client IP is not allowed.",
+	ErrorRateLimited:      "Too many requests. Retry after a while.",
+	ErrorQuotaExceeded:    "The daily quota of requests is exceeded.",
+	ErrorQuotaUnavailable: "The daily quota of requests can not be checked now.",
+	ErrorRequestTooLarge:  "The request body is too large.",
+	ErrorUnauthorized:     "The request is not authenticated.",
+	ErrorInvalidSignature: "The signature of the request is invalid.",
+	ErrorBadPath:          "The path of the request is not canonical.",
+}
+
+const defaultErrorHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .Detail}}<pre>{{.Detail}}</pre>
+{{end}}<p><small>category: {{.Category}}{{if .RequestID}}, request id: {{.RequestID}}{{end}}, time: {{.Time}}</small></p>
+</body>
+</html>
+`
+
+const defaultErrorJSON = `{"error":{"status":{{.Status}},"category":{{json .Category}},"message":{{json .Message}},` +
+	`{{if .Detail}}"detail":{{json .Detail}},{{end}}"requestId":{{json .RequestID}},"time":{{json .Time}}}}
+`
+
+// ErrorPage is the data of error templates.
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Category   string
+	Message    string
+	// Detail is the error text. It is empty unless ErrorResponder.Detail is true.
+	Detail    string
+	RequestID string
+	Endpoint  string
+	Time      string
+}
+
+// ErrorResponder writes error responses of the forwarder as HTML or JSON according to Accept header.
+type ErrorResponder struct {
+	HTML *htmltemplate.Template
+	JSON *template.Template
+	// Detail includes the error text in responses. It may reveal the local network.
+	Detail bool
+}
+
+// NewErrorResponder creates ErrorResponder.
+// htmlFile and jsonFile are /path/to/template. Empty means the default template.
+func NewErrorResponder(htmlFile, jsonFile string, detail bool) (*ErrorResponder, error) {
+	htmlText, jsonText := defaultErrorHTML, defaultErrorJSON
+	if htmlFile != "" {
+		b, err := ioutil.ReadFile(htmlFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** ReadFile: %s", htmlFile)
+		}
+		htmlText = string(b)
+	}
+	if jsonFile != "" {
+		b, err := ioutil.ReadFile(jsonFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** ReadFile: %s", jsonFile)
+		}
+		jsonText = string(b)
+	}
+
+	h, err := htmltemplate.New("html").Parse(htmlText)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Parse HTML template")
+	}
+	j, err := template.New("json").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(jsonText)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Parse JSON template")
+	}
+	return &ErrorResponder{HTML: h, JSON: j, Detail: detail}, nil
+}
+
+// prefersHTML reports whether the client accepts HTML rather than JSON. e.g. browsers.
+func prefersHTML(r *http.Request) bool {
+	accept := strings.ToLower(r.Header.Get("Accept"))
+	if strings.Contains(accept, "json") {
+		return false
+	}
+	return strings.Contains(accept, "text/html")
+}
+
+// Respond writes the error response.
+func (e *ErrorResponder) Respond(w http.ResponseWriter, r *http.Request, status int, category string, cause error) {
+	logger := forward.ExtractLogger(r.Context()).Sugar()
+	endpoint := extractEndpoint(r.Context()).Name
+	label := endpoint
+	if label == "" {
+		label = "-"
+	}
+	metricErrors.WithLabelValues(label, category).Inc()
+
+	page := &ErrorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Category:   category,
+		Message:    errorMessages[category],
+		RequestID:  forward.ExtractRequestID(r.Context()),
+		Endpoint:   endpoint,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+	}
+	if e.Detail && cause != nil {
+		page.Detail = cause.Error()
+	}
+
+	buf := &bytes.Buffer{}
+	contentType := "application/json; charset=utf-8"
+	var err error
+	if prefersHTML(r) {
+		contentType = "text/html; charset=utf-8"
+		err = e.HTML.Execute(buf, page)
+	} else {
+		err = e.JSON.Execute(buf, page)
+	}
+	if err != nil {
+		logger.Errorf("*** Execute error template: %v", err)
+		buf.Reset()
+		contentType = "text/plain; charset=utf-8"
+		buf.WriteString(page.Message + "\n")
+	}
+
+	h := w.Header()
+	h.Set("X-Forward-Error", category)
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+)
+
+// IPList is the list of CIDR ranges.
+type IPList []*net.IPNet
+
+func (l IPList) Contains(ip net.IP) bool {
+	for _, e := range l {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPListLoader parses IP list and resolves presets.
+type IPListLoader struct {
+	// PresetsFile is JSON file of preset name to array of CIDR.
+	PresetsFile string
+
+	presets map[string][]string
+}
+
+// Load parses entries separated by white spaces or commas.
+//
+//	192.0.2.0/24    CIDR
+//	192.0.2.1       Single address
+//	preset:github   Ranges of the preset in PresetsFile
+//	@/path/to/file  Entries in the file. One entry per line. Lines start with '#' are ignored.
+func (l *IPListLoader) Load(s string) (IPList, error) {
+	var ret IPList
+	for _, e := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		switch {
+		case strings.HasPrefix(e, "preset:"):
+			ranges, err := l.preset(e[len("preset:"):])
+			if err != nil {
+				return nil, err
+			}
+			list, err := l.Load(strings.Join(ranges, ","))
+			if err != nil {
+				return nil, errors.Wrapf(err, "*** %s", e)
+			}
+			ret = append(ret, list...)
+		case strings.HasPrefix(e, "@"):
+			list, err := l.loadFile(e[1:])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, list...)
+		default:
+			n, err := parseCIDR(e)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, n)
+		}
+	}
+	return ret, nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** ParseCIDR")
+	}
+	return n, nil
+}
+
+func (l *IPListLoader) loadFile(file string) (IPList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Open: %s", file)
+	}
+	defer f.Close()
+
+	var ret IPList
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list, err := l.Load(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** %s", file)
+		}
+		ret = append(ret, list...)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrapf(err, "*** Scan: %s", file)
+	}
+	return ret, nil
+}
+
+func (l *IPListLoader) preset(name string) ([]string, error) {
+	if l.presets == nil {
+		b, err := ioutil.ReadFile(l.PresetsFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** ReadFile: %s", l.PresetsFile)
+		}
+		if err := json.Unmarshal(b, &l.presets); err != nil {
+			return nil, errors.Wrapf(err, "*** Unmarshal: %s", l.PresetsFile)
+		}
+	}
+
+	ranges, ok := l.presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset: %s", name)
+	}
+	return ranges, nil
+}
+
+// NewIPFilterMiddleware creates middleware which rejects the request from denied IP or not allowed IP.
+// When allow is empty, all IPs except deny are allowed.
+func NewIPFilterMiddleware(allow, deny IPList, clientIP func(r *http.Request) net.IP, errorPages *ErrorResponder) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			if ip == nil || deny.Contains(ip) || len(allow) > 0 && !allow.Contains(ip) {
+				forward.ExtractLogger(r.Context()).Sugar().Warnf("Forbidden IP: %s", ip)
+				errorPages.Respond(w, r, http.StatusForbidden, ErrorForbiddenIP, fmt.Errorf("forbidden IP: %s", ip))
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
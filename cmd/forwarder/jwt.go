@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// hash functions for crypto.Hash
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/pkg/errors"
+)
+
+// JWKS holds public keys from JWK Set file or URL.
+type JWKS struct {
+	Source string
+	// Keys are reloaded from URL after this interval.
+	RefreshInterval time.Duration
+
+	mu      sync.RWMutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func NewJWKS(source string) (*JWKS, error) {
+	j := &JWKS{
+		Source:          source,
+		RefreshInterval: time.Hour,
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *JWKS) isURL() bool {
+	return strings.HasPrefix(j.Source, "https://") || strings.HasPrefix(j.Source, "http://")
+}
+
+func (j *JWKS) load() error {
+	var b []byte
+	if j.isURL() {
+		client := &http.Client{Timeout: time.Second * 10}
+		res, err := client.Get(j.Source)
+		if err != nil {
+			return errors.Wrapf(err, "*** Get JWKS: %s", j.Source)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("get JWKS: %s, status=%d", j.Source, res.StatusCode)
+		}
+		b, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return errors.Wrapf(err, "*** ReadAll JWKS: %s", j.Source)
+		}
+	} else {
+		var err error
+		b, err = ioutil.ReadFile(j.Source)
+		if err != nil {
+			return errors.Wrapf(err, "*** ReadFile JWKS: %s", j.Source)
+		}
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return errors.Wrapf(err, "*** Unmarshal JWKS: %s", j.Source)
+	}
+
+	keys := map[string]interface{}{}
+	for _, e := range set.Keys {
+		key, err := e.publicKey()
+		if err != nil {
+			return errors.Wrapf(err, "*** JWK kid=%s", e.Kid)
+		}
+		keys[e.Kid] = key
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+	j.fetched = time.Now()
+
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported kty: %s", k.Kty)
+}
+
+// Key returns the key of kid.
+// Keys from URL are reloaded when they are too old or kid is unknown.
+func (j *JWKS) Key(kid string) (interface{}, error) {
+	j.mu.RLock()
+	key, ok := j.keys[kid]
+	stale := time.Since(j.fetched) > j.RefreshInterval
+	j.mu.RUnlock()
+
+	// Unknown kid triggers reload at most once per minute.
+	if j.isURL() && (stale || !ok && time.Since(j.fetched) > time.Minute) {
+		if err := j.load(); err != nil {
+			return nil, err
+		}
+		j.mu.RLock()
+		key, ok = j.keys[kid]
+		j.mu.RUnlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+	return key, nil
+}
+
+// JWTVerifier verifies signature and claims of JWT.
+type JWTVerifier struct {
+	JWKS *JWKS
+	// Issuer is checked with "iss" when it is not empty.
+	Issuer string
+	// Audience is checked with "aud" when it is not empty.
+	Audience string
+	Leeway   time.Duration
+	// AllowNoExp accepts the token without "exp", which is valid forever.
+	AllowNoExp bool
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *json.Number    `json:"exp"`
+	Nbf *json.Number    `json:"nbf"`
+}
+
+func (c jwtClaims) hasAudience(aud string) bool {
+	var one string
+	if err := json.Unmarshal(c.Aud, &one); err == nil {
+		return one == aud
+	}
+	var many []string
+	if err := json.Unmarshal(c.Aud, &many); err == nil {
+		for _, e := range many {
+			if e == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *JWTVerifier) Verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return errors.Wrapf(err, "*** header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.Wrapf(err, "*** signature")
+	}
+
+	key, err := v.JWKS.Key(header.Kid)
+	if err != nil {
+		return err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return errors.Wrapf(err, "*** claims")
+	}
+
+	now := time.Now()
+	if claims.Exp != nil {
+		exp, err := claims.Exp.Int64()
+		if err != nil || now.After(time.Unix(exp, 0).Add(v.Leeway)) {
+			return fmt.Errorf("token expired")
+		}
+	} else if !v.AllowNoExp {
+		return fmt.Errorf("exp is missing")
+	}
+	if claims.Nbf != nil {
+		nbf, err := claims.Nbf.Int64()
+		if err != nil || now.Before(time.Unix(nbf, 0).Add(-v.Leeway)) {
+			return fmt.Errorf("token not valid yet")
+		}
+	}
+	if v.Issuer != "" && claims.Iss != v.Issuer {
+		return fmt.Errorf("iss mismatch: %s", claims.Iss)
+	}
+	if v.Audience != "" && !claims.hasAudience(v.Audience) {
+		return fmt.Errorf("aud mismatch")
+	}
+
+	return nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJWTSignature(alg string, key interface{}, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg: %s", alg)
+	}
+
+	var h crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg: %s", alg)
+	}
+	hasher := h.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key mismatch for alg: %s", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, h, digest, sig)
+	case strings.HasPrefix(alg, "PS"):
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key mismatch for alg: %s", alg)
+		}
+		return rsa.VerifyPSS(k, h, digest, sig, nil)
+	case strings.HasPrefix(alg, "ES"):
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key mismatch for alg: %s", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != size*2 {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case strings.HasPrefix(alg, "HS"):
+		k, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("key mismatch for alg: %s", alg)
+		}
+		mac := hmac.New(h.New, k)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported alg: %s", alg)
+}
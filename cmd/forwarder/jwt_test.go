@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testJWTKeys struct {
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	hmac []byte
+}
+
+func newTestJWTKeys(t *testing.T) *testJWTKeys {
+	t.Helper()
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testJWTKeys{rsa: rk, ec: ek, hmac: []byte("hmac-secret")}
+}
+
+// jwks returns JWK Set of the keys whose kid are "rsa", "ec" and "hmac".
+func (k *testJWTKeys) jwks() []byte {
+	enc := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"keys": []jwk{
+			{Kty: "RSA", Kid: "rsa", N: enc(k.rsa.N.Bytes()), E: enc(big.NewInt(int64(k.rsa.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: enc(k.ec.X.Bytes()), Y: enc(k.ec.Y.Bytes())},
+			{Kty: "oct", Kid: "hmac", K: enc(k.hmac)},
+		},
+	})
+	return b
+}
+
+func (k *testJWTKeys) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	hb, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	cb, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[32-len(rb):32], rb)
+			copy(sig[64-len(sb):], sb)
+		}
+	case "HS256":
+		mac := hmac.New(sha256.New, k.hmac)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	default:
+		t.Fatalf("unsupported alg: %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeTestJWKS writes JWK Set file of the keys. The returned func removes it.
+func writeTestJWKS(t *testing.T, keys *testJWTKeys) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(file, keys.jwks(), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return file, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	file, cleanup := writeTestJWKS(t, keys)
+	defer cleanup()
+	jwks, err := NewJWKS(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"iss": "https://issuer", "aud": "forwarder", "exp": now + 60}
+	with := func(k string, v interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for ck, cv := range valid {
+			c[ck] = cv
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name       string
+		token      string
+		allowNoExp bool
+		ok         bool
+	}{
+		{"RS256", keys.sign(t, "RS256", "rsa", valid), false, true},
+		{"PS256", keys.sign(t, "PS256", "rsa", valid), false, true},
+		{"ES256", keys.sign(t, "ES256", "ec", valid), false, true},
+		{"HS256", keys.sign(t, "HS256", "hmac", valid), false, true},
+		{"aud array", keys.sign(t, "RS256", "rsa", with("aud", []string{"other", "forwarder"})), false, true},
+		{"expired within leeway", keys.sign(t, "RS256", "rsa", with("exp", now-30)), false, true},
+		{"expired", keys.sign(t, "RS256", "rsa", with("exp", now-120)), false, false},
+		{"nbf in future", keys.sign(t, "RS256", "rsa", with("nbf", now+120)), false, false},
+		{"no exp", keys.sign(t, "RS256", "rsa", with("exp", nil)), false, false},
+		{"no exp allowed", keys.sign(t, "RS256", "rsa", with("exp", nil)), true, true},
+		{"iss mismatch", keys.sign(t, "RS256", "rsa", with("iss", "https://other")), false, false},
+		{"aud mismatch", keys.sign(t, "RS256", "rsa", with("aud", "other")), false, false},
+		{"unknown kid", keys.sign(t, "RS256", "unknown", valid), false, false},
+		// HMAC with the RSA key must not be accepted.
+		{"alg key mismatch", keys.sign(t, "HS256", "rsa", valid), false, false},
+		{"none", "eyJhbGciOiJub25lIiwia2lkIjoicnNhIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp":9999999999}`)) + ".", false, false},
+		{"tampered", keys.sign(t, "RS256", "rsa", valid) + "x", false, false},
+		{"malformed", "a.b", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := &JWTVerifier{
+				JWKS:       jwks,
+				Issuer:     "https://issuer",
+				Audience:   "forwarder",
+				Leeway:     time.Minute,
+				AllowNoExp: tc.allowNoExp,
+			}
+			if err := v.Verify(tc.token); (err == nil) != tc.ok {
+				t.Errorf("err=%v", err)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	file, cleanup := writeTestJWKS(t, newTestJWTKeys(t))
+	defer cleanup()
+	for _, tc := range []struct {
+		policy string
+		ok     bool
+	}{
+		{"none", true},
+		{"bearer:t1,t2", true},
+		{"basic:alice:$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", true},
+		{"basic:alice:plain", false},
+		{"jwt:" + file, true},
+		{"jwt:" + file + ";iss=https://issuer;aud=forwarder;exp=optional", true},
+		{"jwt:" + file + ";exp=required", false},
+		{"jwt:" + file + ";unknown=x", false},
+		{"jwt:/nonexistent/jwks.json", false},
+		{"bearer:", false},
+		{"unknown:x", false},
+	} {
+		if _, err := NewAuthenticator(tc.policy); (err == nil) != tc.ok {
+			t.Errorf("%s: err=%v", tc.policy, err)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	file, cleanup := writeTestJWKS(t, keys)
+	defer cleanup()
+	errorPages, err := NewErrorResponder("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, err := NewAuthMiddleware("/public=none /admin=bearer:secret-token /api=jwt:"+file, errorPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	token := keys.sign(t, "ES256", "ec", map[string]interface{}{"exp": time.Now().Unix() + 60})
+	for _, tc := range []struct {
+		uri           string
+		authorization string
+		want          int
+	}{
+		{"/public/x", "", http.StatusOK},
+		{"/other", "", http.StatusOK},
+		{"/admin", "Bearer secret-token", http.StatusOK},
+		{"/admin/x", "bearer secret-token", http.StatusOK},
+		{"/admin/x", "Bearer wrong", http.StatusUnauthorized},
+		{"/admin/x", "", http.StatusUnauthorized},
+		// Dot-segments and duplicated slashes must not skip the authentication.
+		{"/./admin/x", "", http.StatusUnauthorized},
+		{"/public/../admin/x", "", http.StatusUnauthorized},
+		{"//admin", "", http.StatusUnauthorized},
+		{"/administrator", "", http.StatusOK},
+		{"/api/x", "Bearer " + token, http.StatusOK},
+		{"/api/x", "Bearer secret-token", http.StatusUnauthorized},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got %d, want %d", w.Code, tc.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("WWW-Authenticate is missing")
+			}
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/http/pprof"
@@ -23,13 +22,13 @@ import (
 
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/profiler"
-	"contrib.go.opencensus.io/exporter/stackdriver"
 	firebase "firebase.google.com/go"
 	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	forward "github.com/tckz/personal-forward"
-	"go.opencensus.io/exporter/stackdriver/propagation"
-	"go.opencensus.io/plugin/ochttp"
-	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/plugin/othttp"
 	"go.uber.org/zap"
 	goji "goji.io"
 	"goji.io/pat"
@@ -94,6 +93,13 @@ func main() {
 
 }
 
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
 func initFirestore(ctx context.Context) *firestore.Client {
 	var opts []option.ClientOption
 	if *optJSONKey != "" {
@@ -113,6 +119,36 @@ func initFirestore(ctx context.Context) *firestore.Client {
 	return client
 }
 
+// cancelRequest marks the request as cancelled so that the consumer aborts forwarding, and deletes the request and its chunks.
+// It is called when the client has gone or the response has not arrived in time.
+func cancelRequest(client *firestore.Client, ref *firestore.DocumentRef, logger *zap.SugaredLogger) {
+	metricCancelled.WithLabelValues(ref.Parent.Parent.ID).Inc()
+
+	// ctx of the request may be already done.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, err := ref.Update(ctx, []firestore.Update{
+		{
+			Path:  "cancelled",
+			Value: firestore.ServerTimestamp,
+		},
+	}, firestore.Exists)
+	if err != nil {
+		if s, ok := err.(forward.GRPCStatusHolder); ok && s.GRPCStatus().Code() == codes.NotFound {
+			return
+		}
+		logger.Warnf("*** Update cancelled: %v", err)
+	}
+
+	if err := forward.DeleteRequest(ctx, client, ref); err != nil {
+		metricFirestoreErrors.WithLabelValues("delete").Inc()
+		logger.Errorf("*** DeleteRequest: %v", err)
+		return
+	}
+	logger.Infof("cancelled=%s", ref.Path)
+}
+
 func run() {
 	defaultBind := ":3000"
 	if port := os.Getenv("PORT"); port != "" {
@@ -120,14 +156,82 @@ func run() {
 	}
 
 	defaultSdProfiler, _ := strconv.ParseBool(os.Getenv("ENABLE_SD_PROFILER"))
+	defaultRatePerIP, _ := strconv.ParseFloat(os.Getenv("RATE_PER_IP"), 64)
+	defaultBurstPerIP, err := strconv.Atoi(os.Getenv("BURST_PER_IP"))
+	if err != nil {
+		defaultBurstPerIP = 10
+	}
+	defaultRatePerEndpoint, _ := strconv.ParseFloat(os.Getenv("RATE_PER_ENDPOINT"), 64)
+	defaultBurstPerEndpoint, err := strconv.Atoi(os.Getenv("BURST_PER_ENDPOINT"))
+	if err != nil {
+		defaultBurstPerEndpoint = 50
+	}
+	defaultDailyQuota, _ := strconv.ParseInt(os.Getenv("DAILY_QUOTA"), 10, 64)
+	defaultQuotaFlushInterval, err := time.ParseDuration(os.Getenv("QUOTA_FLUSH_INTERVAL"))
+	if err != nil {
+		defaultQuotaFlushInterval = time.Second * 5
+	}
+	defaultMaxRequestBytes, err := strconv.ParseInt(os.Getenv("MAX_REQUEST_BYTES"), 10, 64)
+	if err != nil {
+		// Document of Firestore must be smaller than 1MiB
+		defaultMaxRequestBytes = 1000 * 1000
+	}
+	defaultSweepInterval, _ := time.ParseDuration(os.Getenv("SWEEP_INTERVAL"))
+	defaultSweepExpire, err := time.ParseDuration(os.Getenv("SWEEP_EXPIRE"))
+	if err != nil {
+		defaultSweepExpire = time.Minute * 10
+	}
+	defaultSweepDryRun, _ := strconv.ParseBool(os.Getenv("SWEEP_DRY_RUN"))
+	defaultCacheMaxBytes, _ := strconv.ParseInt(os.Getenv("CACHE_MAX_BYTES"), 10, 64)
+	defaultCacheMaxEntryBytes, err := strconv.ParseInt(os.Getenv("CACHE_MAX_ENTRY_BYTES"), 10, 64)
+	if err != nil {
+		defaultCacheMaxEntryBytes = 1024 * 1024
+	}
 
 	projectID := flag.String("project-id", os.Getenv("GOOGLE_CLOUD_PROJECT"), "ProjectID of GCP")
 	bind := flag.String("bind", defaultBind, "Listen addr:port")
-	bindStats := flag.String("bind-stats", ":3001", "Listen addr:port for pprof")
+	bindStats := flag.String("bind-stats", ":3001", "Listen addr:port for pprof and /metrics")
 	enableSDProfiler := flag.Bool("enable-sd-profiler", defaultSdProfiler, "Enable Stackdriver Profiler")
 	timeoutSec := flag.Int("shutdown-timeout-sec", 5, "Timeout sec for waiting shutdown")
 	blockProfileRate := flag.Int("block-profile-rate", 0, "Number of runtime.MemProfileRate. Value 1 is the finest")
-	optEndPointName := flag.String("endpoint-name", os.Getenv("ENDPOINT_NAME"), "Identity of endpoint")
+	optEndPointName := flag.String("endpoint-name", os.Getenv("ENDPOINT_NAME"), "Identity of default endpoint")
+	endpointHosts := flag.String("endpoint-hosts", os.Getenv("ENDPOINT_HOSTS"), "Route by Host header. 'host=endpoint' separated by white spaces. '*.example.com=*' means the first label is endpoint, which must be in --endpoint-names or the registry")
+	endpointNames := flag.String("endpoint-names", os.Getenv("ENDPOINT_NAMES"), "Endpoints which are routed by --endpoint-path-prefix or the wildcard of --endpoint-hosts. Separated by white spaces or commas")
+	endpointPathPrefix := flag.Bool("endpoint-path-prefix", os.Getenv("ENDPOINT_PATH_PREFIX") == "true", "Route by the first segment of the path, which is removed from relayed URI")
+	endpointRegistry := flag.Bool("endpoint-registry", os.Getenv("ENDPOINT_REGISTRY") == "true", "Route only to endpoints which are registered and enabled in 'endpoints' collection of Firestore")
+	ipAllow := flag.String("ip-allow", os.Getenv("IP_ALLOW"), "Allowed client IPs. CIDR, preset:name or @/path/to/file separated by white spaces or commas")
+	ipDeny := flag.String("ip-deny", os.Getenv("IP_DENY"), "Denied client IPs. Same format as --ip-allow")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Proxies in front of the forwarder whose X-Forwarded-For is trusted. Same format as --ip-allow")
+	ipPresets := flag.String("ip-presets", envOrDefault("IP_PRESETS_FILE", "ip_presets.json"), "/path/to/presets.json for preset:name of --ip-allow/--ip-deny")
+	ratePerIP := flag.Float64("rate-per-ip", defaultRatePerIP, "Requests per second per client IP. 0 is unlimited")
+	burstPerIP := flag.Int("burst-per-ip", defaultBurstPerIP, "Burst of requests per client IP")
+	ratePerEndpoint := flag.Float64("rate-per-endpoint", defaultRatePerEndpoint, "Requests per second per endpoint. 0 is unlimited")
+	burstPerEndpoint := flag.Int("burst-per-endpoint", defaultBurstPerEndpoint, "Burst of requests per endpoint")
+	dailyQuota := flag.Int64("daily-quota", defaultDailyQuota, "Number of requests per day(UTC). 0 is unlimited")
+	quotaFlushInterval := flag.Duration("quota-flush-interval", defaultQuotaFlushInterval, "Interval to share the count of --daily-quota among instances")
+	quotaFailOpen := flag.Bool("quota-fail-open", os.Getenv("QUOTA_FAIL_OPEN") == "true", "Allow requests while the count of --daily-quota can not be shared. Otherwise they are rejected with 503")
+	payloadKeys := flag.String("payload-keys", os.Getenv("PAYLOAD_KEYS"), "Keys to encrypt payloads. 'id:base64key' separated by commas or @/path/to/keyfile. The first key is used to encrypt")
+	compress := flag.String("compress", os.Getenv("COMPRESS"), "Compress request body stored in Firestore. gzip or zstd")
+	compressMinBytes := flag.Int("compress-min-bytes", 1024, "Body smaller than this is not compressed")
+	maxRequestBytes := flag.Int64("max-request-bytes", defaultMaxRequestBytes, "Max size of request body. 0 is unlimited")
+	maxRequestBytesByPrefix := flag.String("max-request-bytes-by-prefix", os.Getenv("MAX_REQUEST_BYTES_BY_PREFIX"), "Max size of request body per path prefix. '/prefix=bytes' separated by white spaces")
+	authPolicies := flag.String("auth-policies", os.Getenv("AUTH_POLICIES"), "Authentication policies. '/prefix=policy' separated by white spaces")
+	verifySignature := flag.String("verify-signature", os.Getenv("VERIFY_SIGNATURE"), "Rules of webhook signature verification. '/prefix=kind:secret' separated by white spaces")
+	sweepInterval := flag.Duration("sweep-interval", defaultSweepInterval, "Interval to delete expired requests and orphaned chunks. 0 is disabled")
+	sweepExpire := flag.Duration("sweep-expire", defaultSweepExpire, "Requests older than this are deleted by sweeper")
+	sweepDryRun := flag.Bool("sweep-dry-run", defaultSweepDryRun, "Sweeper only reports documents to be deleted")
+	traceExporter := flag.String("trace-exporter", envOrDefault("TRACE_EXPORTER", forward.TraceExporterNone), "Exporter of traces. otlp, stdout or none")
+	otlpAddress := flag.String("otlp-address", envOrDefault("OTLP_ADDRESS", "localhost:55680"), "host:port of OpenTelemetry collector for --trace-exporter otlp")
+	signatureTolerance := flag.Duration("signature-tolerance", time.Minute*5, "Tolerance of timestamp of webhook signature")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", defaultCacheMaxBytes, "Max total size of responses cached in memory. 0 disables the cache")
+	cacheMaxEntryBytes := flag.Int64("cache-max-entry-bytes", defaultCacheMaxEntryBytes, "Responses larger than this are not cached")
+	responseCompress := flag.String("response-compress", os.Getenv("RESPONSE_COMPRESS"), "Compress responses according to Accept-Encoding of the client. br and gzip in order of preference separated by commas. Empty is disabled")
+	responseCompressTypes := flag.String("response-compress-types", envOrDefault("RESPONSE_COMPRESS_TYPES", "text/* application/json application/*+json application/javascript application/xml application/*+xml image/svg+xml"), "Patterns of media type of responses which are compressed. Separated by white spaces or commas")
+	responseCompressMinBytes := flag.Int("response-compress-min-bytes", 1024, "Response body smaller than this is not compressed")
+	errorTemplateHTML := flag.String("error-template-html", os.Getenv("ERROR_TEMPLATE_HTML"), "/path/to/template of HTML error responses. The default template is used when empty")
+	errorTemplateJSON := flag.String("error-template-json", os.Getenv("ERROR_TEMPLATE_JSON"), "/path/to/template of JSON error responses. The default template is used when empty")
+	errorDetail := flag.Bool("error-detail", os.Getenv("ERROR_DETAIL") == "true", "Include error text in error responses. It may reveal the local network")
+	cacheKeyHeaders := flag.String("cache-key-headers", envOrDefault("CACHE_KEY_HEADERS", "Accept-Encoding"), "Request headers which are part of the cache key. Separated by white spaces or commas")
 	flag.Parse()
 
 	// Log at any loglevel
@@ -146,11 +250,31 @@ func run() {
 		// default EP name under GAE
 		if svcName := os.Getenv("GAE_SERVICE"); svcName != "" {
 			endPointName = svcName
-		} else {
+		} else if *endpointHosts == "" && !*endpointPathPrefix && !*endpointRegistry {
 			logger.Panicf("endpoint-name must be specified")
 		}
 	}
 
+	router, err := NewEndpointRouter(endPointName, *endpointHosts, *endpointNames, *endpointPathPrefix)
+	if err != nil {
+		logger.Panicf("*** NewEndpointRouter: %v", err)
+	}
+	router.Registered = *endpointRegistry
+
+	if err := forward.ValidateEncoding(*compress); err != nil {
+		logger.Panicf("*** --compress: %v", err)
+	}
+
+	var keyring *forward.Keyring
+	if *payloadKeys != "" {
+		kr, err := forward.LoadKeyring(*payloadKeys)
+		if err != nil {
+			logger.Panicf("*** LoadKeyring: %v", err)
+		}
+		logger.Infof("Payloads are encrypted with key=%s", kr.CurrentID)
+		keyring = kr
+	}
+
 	if *bindStats != "" {
 		statsMux := http.NewServeMux()
 		statsMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -158,6 +282,7 @@ func run() {
 		statsMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		statsMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 		statsMux.HandleFunc("/debug/pprof/", pprof.Index)
+		statsMux.Handle("/metrics", promhttp.Handler())
 		go func() {
 			if err := http.ListenAndServe(*bindStats, statsMux); err != nil && err != http.ErrServerClosed {
 				logger.With(zap.Error(err)).Fatalf("*** http.ListenAndServe")
@@ -165,6 +290,27 @@ func run() {
 		}()
 	}
 
+	errorPages, err := NewErrorResponder(*errorTemplateHTML, *errorTemplateJSON, *errorDetail)
+	if err != nil {
+		logger.Panicf("*** NewErrorResponder: %v", err)
+	}
+
+	var compressor *ResponseCompressor
+	if *responseCompress != "" {
+		c, err := NewResponseCompressor(*responseCompress, *responseCompressTypes, *responseCompressMinBytes)
+		if err != nil {
+			logger.Panicf("*** NewResponseCompressor: %v", err)
+		}
+		logger.Infof("Response compression: encodings=%v, types=%v", c.Encodings, c.Types)
+		compressor = c
+	}
+
+	var cache *ResponseCache
+	if *cacheMaxBytes > 0 {
+		cache = NewResponseCache(*cacheMaxBytes, *cacheMaxEntryBytes, *cacheKeyHeaders)
+		logger.Infof("Response cache: maxBytes=%d, maxEntryBytes=%d, keyHeaders=%v", cache.MaxBytes, cache.MaxEntryBytes, cache.KeyHeaders)
+	}
+
 	var client *firestore.Client
 	func() {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
@@ -173,6 +319,23 @@ func run() {
 	}()
 	defer client.Close()
 
+	if *endpointRegistry {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go router.WatchRegistry(ctx, client)
+	}
+
+	if *sweepInterval > 0 {
+		ctx, cancel := context.WithCancel(forward.WithLogger(context.Background(), logger.Desugar()))
+		defer cancel()
+		sweeper := &forward.Sweeper{
+			Client: client,
+			Expire: *sweepExpire,
+			DryRun: *sweepDryRun,
+		}
+		go sweeper.Run(ctx, *sweepInterval)
+	}
+
 	if *enableSDProfiler {
 		logger.Infof("Enable Stackdriver profiler")
 		if err := profiler.Start(profiler.Config{
@@ -185,43 +348,53 @@ func run() {
 		}
 	}
 
-	exporter, err := stackdriver.NewExporter(stackdriver.Options{})
+	stopTracer, err := forward.InitTracer(*traceExporter, *otlpAddress, myName)
 	if err != nil {
-		logger.Fatalf("*** stackdriver.NewExporter(): %v", err)
+		logger.Fatalf("*** InitTracer: %v", err)
 	}
-	defer exporter.Flush()
-	octrace.RegisterExporter(exporter)
-	octrace.ApplyConfig(octrace.Config{DefaultSampler: octrace.AlwaysSample()})
-
-	propg := &propagation.HTTPFormat{}
+	defer stopTracer()
 
 	mux := goji.NewMux()
 
 	// MW for tracing
 	mux.Use(func(h http.Handler) http.Handler {
-		return &ochttp.Handler{
-			Handler:     h,
-			Propagation: &propagation.HTTPFormat{},
-			FormatSpanName: func(r *http.Request) string {
+		// The trace context from the internet is linked, not continued.
+		return othttp.NewHandler(h, "receive",
+			othttp.WithPublicEndpoint(),
+			othttp.WithPropagators(forward.Propagators),
+			othttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
 				return myName + ":" + r.URL.Path
-			},
-		}
+			}),
+		)
 	})
 
-	// MW for logging/recover
+	// MW for request ID/logging/recover
 	mux.Use(func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			logger := logger
-			span := octrace.FromContext(r.Context())
-			if span != nil {
-				sc := span.SpanContext()
-				tid := sc.TraceID.String()
+			// The request ID from the client is accepted so that it can correlate its own logs.
+			// It is relayed in the header to the upstream and echoed on the response.
+			requestID := r.Header.Get(forward.RequestIDHeader)
+			if !forward.ValidRequestID(requestID) {
+				requestID = forward.NewRequestID()
+				r.Header.Set(forward.RequestIDHeader, requestID)
+			}
+			w.Header().Set(forward.RequestIDHeader, requestID)
+
+			logger := logger.With(zap.String("requestId", requestID))
+			span := trace.SpanFromContext(r.Context())
+			// The trace of GAE is preferred, since the span from the internet is not continued.
+			tid := cloudTraceID(r.Header)
+			if sc := span.SpanContext(); tid == "" && sc.IsValid() {
+				tid = sc.TraceID.String()
+			}
+			if tid != "" {
 				logger = logger.With(zap.String("logging.googleapis.com/trace",
 					fmt.Sprintf("projects/%s/traces/%s", *projectID, tid)))
 			}
 
-			r = r.WithContext(forward.WithLogger(r.Context(), logger.Desugar()))
+			r = r.WithContext(forward.WithRequestID(forward.WithLogger(r.Context(), logger.Desugar()), requestID))
 
+			req := r
 			defer func() {
 				if r := recover(); r != nil {
 					var err error
@@ -232,13 +405,8 @@ func run() {
 					}
 					logger.With(zap.Stack("stack"), zap.Error(err)).
 						Errorf("*** panic: %v", r)
-					w.WriteHeader(http.StatusInternalServerError)
-					if span != nil {
-						span.SetStatus(octrace.Status{
-							Code:    int32(codes.Internal),
-							Message: err.Error(),
-						})
-					}
+					errorPages.Respond(w, req, http.StatusInternalServerError, ErrorInternal, err)
+					span.SetStatus(codes.Internal, err.Error())
 				}
 			}()
 
@@ -246,57 +414,192 @@ func run() {
 		})
 	})
 
+	mux.Use(NewMetricsMiddleware())
+	mux.Use(NewCanonicalPathMiddleware(errorPages))
+
+	loader := &IPListLoader{PresetsFile: *ipPresets}
+	proxies, err := loader.Load(*trustedProxies)
+	if err != nil {
+		logger.Panicf("*** Load trusted-proxies: %v", err)
+	}
+	resolver := &ClientIPResolver{
+		// X-Appengine-User-Ip can be forged unless the frontend of GAE overwrites it.
+		AppEngine:      os.Getenv("GAE_ENV") != "",
+		TrustedProxies: proxies,
+	}
+
+	if *ipAllow != "" || *ipDeny != "" {
+		allow, err := loader.Load(*ipAllow)
+		if err != nil {
+			logger.Panicf("*** Load ip-allow: %v", err)
+		}
+		deny, err := loader.Load(*ipDeny)
+		if err != nil {
+			logger.Panicf("*** Load ip-deny: %v", err)
+		}
+		logger.Infof("IP filter: allow=%d, deny=%d", len(allow), len(deny))
+		mux.Use(NewIPFilterMiddleware(allow, deny, resolver.ClientIP, errorPages))
+	}
+
+	if *ratePerIP > 0 {
+		mux.Use(NewIPRateLimitMiddleware(NewRateLimiter(*ratePerIP, *burstPerIP), resolver.ClientIP, errorPages))
+	}
+
+	if *maxRequestBytes > 0 || *maxRequestBytesByPrefix != "" {
+		mw, err := NewBodyLimitMiddleware(*maxRequestBytes, *maxRequestBytesByPrefix, errorPages)
+		if err != nil {
+			logger.Panicf("*** NewBodyLimitMiddleware: %v", err)
+		}
+		mux.Use(mw)
+	}
+
+	if *authPolicies != "" {
+		mw, err := NewAuthMiddleware(*authPolicies, errorPages)
+		if err != nil {
+			logger.Panicf("*** NewAuthMiddleware: %v", err)
+		}
+		mux.Use(mw)
+	}
+
+	if *verifySignature != "" {
+		mw, err := NewSignatureMiddleware(*verifySignature, *signatureTolerance, errorPages)
+		if err != nil {
+			logger.Panicf("*** NewSignatureMiddleware: %v", err)
+		}
+		mux.Use(mw)
+	}
+
+	mux.Use(NewEndpointMiddleware(router, errorPages))
+
+	var quota *DailyQuota
+	if *dailyQuota > 0 {
+		if *quotaFlushInterval <= 0 {
+			logger.Panicf("--quota-flush-interval must be positive")
+		}
+		quota = NewDailyQuota(client, *dailyQuota, *quotaFlushInterval, *quotaFailOpen)
+		func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+			if err := quota.Flush(ctx, time.Now()); err != nil {
+				logger.Errorf("*** DailyQuota.Flush: %v", err)
+			}
+		}()
+		ctx, cancel := context.WithCancel(forward.WithLogger(context.Background(), logger.Desugar()))
+		defer cancel()
+		go quota.Run(ctx)
+	}
+
+	if *ratePerEndpoint > 0 || quota != nil {
+		var limiter *RateLimiter
+		if *ratePerEndpoint > 0 {
+			limiter = NewRateLimiter(*ratePerEndpoint, *burstPerEndpoint)
+		}
+		mux.Use(NewEndpointRateLimitMiddleware(limiter, quota, func(r *http.Request) string {
+			return extractEndpoint(r.Context()).Name
+		}, errorPages))
+	}
+
 	mux.HandleFunc(pat.New("/*"), func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		span := octrace.FromContext(ctx)
 		logger := forward.ExtractLogger(ctx).Sugar()
+		ep := extractEndpoint(ctx)
 
 		if *optDump {
 			b, err := httputil.DumpRequest(r, true)
 			if err != nil {
 				logger.Errorf("*** httputil.DumpRequest: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
+				errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
 				return
 			}
 			fmt.Fprintln(os.Stderr, string(b))
 		}
 
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			logger.Errorf("*** ReadAll: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		b, ok := readBody(w, r, errorPages)
+		if !ok {
 			return
 		}
 
-		header := r.Header
-		if span != nil {
-			propg.SpanContextToRequest(span.SpanContext(), r)
+		var cacheKey string
+		// stale is the cached response which is revalidated by the upstream.
+		var stale *CacheEntry
+		if cache != nil && cache.Cacheable(r) {
+			cacheKey = cache.Key(ep.Name, r, ep.RequestURI)
+			if e := cache.Get(cacheKey, r); e != nil {
+				if e.Fresh(r, time.Now()) {
+					metricCacheLookups.WithLabelValues(ep.Name, CacheHit).Inc()
+					logger.Infof("cache hit: status=%d", e.StatusCode)
+					cache.Serve(w, r, e, CacheHit, time.Now())
+					return
+				}
+				// The conditional request of the client is relayed as is.
+				if !hasConditional(r) {
+					stale = e
+				}
+			}
+		}
+
+		// The consumer continues the trace from the context in the header of the document.
+		enqueueCtx, enqueueSpan := forward.Tracer().Start(ctx, "enqueue", trace.WithSpanKind(trace.SpanKindProducer))
+		// Keep r.Header as the client sent for Serve.
+		header := cloneHeader(r.Header)
+		// r.Header has no Host. The consumer restores the URL which the client requested with it.
+		header.Set("Host", r.Host)
+		if stale != nil && !stale.AddValidators(header) {
+			stale = nil
+		}
+		forward.InjectTraceContext(enqueueCtx, header)
+
+		payload := &forward.RequestPayload{
+			Method:     r.Method,
+			RequestURI: ep.RequestURI,
+			Header:     header,
+			Body:       b,
+		}
+		if err := payload.Compress(*compress, *compressMinBytes); err != nil {
+			enqueueSpan.End()
+			logger.Errorf("*** Compress: %v", err)
+			errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
+			return
 		}
 
-		ref, _, err := client.Collection("endpoints").Doc(endPointName).Collection("requests").
-			Add(ctx, map[string]interface{}{
-				"created": firestore.ServerTimestamp,
-				"request": map[string]interface{}{
-					"httpInfo": map[string]interface{}{
-						"method":     r.Method,
-						"requestURI": r.RequestURI,
-					},
-					"header": header,
-					"body":   b,
-				},
-			})
+		ref := client.Collection("endpoints").Doc(ep.Name).Collection("requests").NewDoc()
+		req, err := forward.EncodeRequest(ref.ID, payload, keyring)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logger.Errorf("*** Add: %v", err)
+			enqueueSpan.End()
+			logger.Errorf("*** EncodeRequest: %v", err)
+			errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
+			return
+		}
+
+		_, err = ref.Create(enqueueCtx, map[string]interface{}{
+			"created":   firestore.ServerTimestamp,
+			"requestId": forward.ExtractRequestID(ctx),
+			"request":   req,
+		})
+		enqueueSpan.End()
+		if err != nil {
+			metricFirestoreErrors.WithLabelValues("create").Inc()
+			logger.Errorf("*** Create: %v", err)
+			errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
 			return
 		}
 		logger.Infof("created=%s", ref.Path)
 
 		// wait response
+		completed := false
+		defer func() {
+			if !completed {
+				cancelRequest(client, ref, logger)
+			}
+		}()
 		func() {
 			ctx, cancel := context.WithTimeout(ctx, *optTimeout)
 			defer cancel()
+			ctx, span := forward.Tracer().Start(ctx, "relay")
+			defer span.End()
 
+			// claimed distinguishes the consumer being slow from no consumer listening.
+			claimed := false
 			it := ref.Snapshots(ctx)
 			defer it.Stop()
 			for {
@@ -305,60 +608,68 @@ func run() {
 					if s, ok := err.(forward.GRPCStatusHolder); err == iterator.Done || ok && s.GRPCStatus().Code() == codes.Canceled {
 						break
 					}
-					w.WriteHeader(http.StatusGatewayTimeout)
 					logger.Errorf("*** it.Next: %v", err)
+					if s, ok := err.(forward.GRPCStatusHolder); !ok || s.GRPCStatus().Code() != codes.DeadlineExceeded {
+						metricFirestoreErrors.WithLabelValues("snapshot").Inc()
+						errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
+					} else if claimed {
+						errorPages.Respond(w, r, http.StatusGatewayTimeout, ErrorTimeout, err)
+					} else {
+						errorPages.Respond(w, r, http.StatusServiceUnavailable, ErrorNoConsumer, err)
+					}
 					return
 				}
 
+				if _, err := data.DataAt("claimed"); err == nil {
+					claimed = true
+				}
+
 				v, err := data.DataAt("response")
 				if v == nil {
 					continue
 				}
 
-				if errText, _ := forward.AsString(data.DataAt("response.error")); errText != "" {
-					w.WriteHeader(http.StatusInternalServerError)
-					logger.Infof("errText: %s", errText)
+				res, err := forward.DecodeResponse(data, keyring)
+				if err != nil {
+					logger.Errorf("*** DecodeResponse: %v", err)
+					errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
 					return
 				}
 
-				code, _ := forward.AsInt64(data.DataAt("response.statusCode"))
-				body, _ := forward.AsByte(data.DataAt("response.body"))
-				chunks, _ := forward.AsInt64(data.DataAt("response.chunks"))
-				header, _ := forward.AsHeader(data.DataAt("response.header"))
-				logger.Infof("response: code=%d, header=%v", code, header)
+				if res.Error != "" {
+					logger.Infof("errText: %s", res.Error)
+					errorPages.Respond(w, r, http.StatusBadGateway, ErrorUpstream, errors.New(res.Error))
+					return
+				}
 
-				// construct response
-				for k, values := range header {
-					for _, e := range values {
-						w.Header().Add(k, e)
-					}
+				if t, err := forward.AsTime(data.DataAt("response.time")); err == nil {
+					metricReturnDuration.WithLabelValues(ep.Name).Observe(time.Since(t).Seconds())
 				}
-				w.WriteHeader(int(code))
+				chunks := int64(res.Chunks)
+				metricResponseChunks.WithLabelValues(ep.Name).Observe(float64(chunks))
+				logger.Infof("response: code=%d, header=%v, chunks=%d", res.StatusCode, res.Header, chunks)
 
-				logger.Infof("response chunks=%d", chunks)
-				if chunks <= 1 {
-					io.Copy(w, bytes.NewReader(body))
-				} else {
+				if chunks > 1 {
 					bodies := map[int64][]byte{}
 					alreadyReceived := mapset.NewSet()
-					func() {
+					err := func() error {
 						it := data.Ref.Collection("responseBodies").Snapshots(ctx)
 						defer it.Stop()
 
 						for int64(alreadyReceived.Cardinality()) != chunks {
 							snapshot, err := it.Next()
 							if err != nil {
-								w.WriteHeader(http.StatusInternalServerError)
-								logger.Errorf("*** it.Next chunks: %v", err)
-								return
+								return errors.Wrapf(err, "*** it.Next chunks")
 							}
 
 							for _, e := range snapshot.Changes {
 								logger.Infof("arrive: %s, kind=%d", e.Doc.Ref.ID, e.Kind)
 								chunkDoc := e.Doc
 								if chunkDoc.Exists() && e.Kind == firestore.DocumentAdded {
-									chunk, _ := forward.AsByte(chunkDoc.DataAt("chunk"))
-									index, _ := forward.AsInt64(chunkDoc.DataAt("index"))
+									index, chunk, err := forward.DecodeChunk(data.Ref.ID, chunkDoc, keyring)
+									if err != nil {
+										return errors.Wrapf(err, "*** DecodeChunk")
+									}
 
 									logger.Infof("Chunk[%d/%d]: size=%d", index+1, chunks, len(chunk))
 									if !alreadyReceived.Contains(index) {
@@ -371,15 +682,65 @@ func run() {
 								}
 							}
 						}
+						return nil
 					}()
+					if err != nil {
+						metricFirestoreErrors.WithLabelValues("chunks").Inc()
+						logger.Errorf("%v", err)
+						errorPages.Respond(w, r, http.StatusBadGateway, ErrorChunkLoss, err)
+						return
+					}
+
+					buf := &bytes.Buffer{}
+					for i := int64(0); i < chunks; i++ {
+						buf.Write(bodies[i])
+					}
+					res.Body = buf.Bytes()
+				}
+
+				if err := res.Decompress(); err != nil {
+					logger.Errorf("*** Decompress: %v", err)
+					errorPages.Respond(w, r, http.StatusInternalServerError, ErrorInternal, err)
+					return
+				}
+
+				if stale != nil && res.StatusCode == http.StatusNotModified {
+					// The cached response is still valid.
+					metricCacheLookups.WithLabelValues(ep.Name, CacheRevalidated).Inc()
+					cache.Serve(w, r, cache.Refresh(stale, res.Header, time.Now()), CacheRevalidated, time.Now())
+				} else {
+					if compressor != nil {
+						// Cached responses are stored compressed, they are keyed by Accept-Encoding or varied by it.
+						if enc, err := compressor.Apply(r, res); err != nil {
+							logger.Errorf("*** Compress response: %v", err)
+						} else if enc != "" {
+							logger.Infof("response compressed: encoding=%s, size=%d", enc, len(res.Body))
+						}
+					}
+					if cacheKey != "" {
+						metricCacheLookups.WithLabelValues(ep.Name, CacheMiss).Inc()
+						cache.Store(cacheKey, r, res, time.Now())
+						w.Header().Set("X-Cache", CacheMiss)
+					}
 
-					for _, b := range bodies {
-						io.Copy(w, bytes.NewReader(b))
+					// construct response
+					for k, values := range res.Header {
+						if k == forward.RequestIDHeader {
+							// Already set by the forwarder.
+							continue
+						}
+						for _, e := range values {
+							w.Header().Add(k, e)
+						}
 					}
+					w.WriteHeader(res.StatusCode)
+					io.Copy(w, bytes.NewReader(res.Body))
 				}
 
+				completed = true
 				_, err = data.Ref.Delete(ctx)
 				if err != nil {
+					metricFirestoreErrors.WithLabelValues("delete").Inc()
 					logger.With(zap.Error(err)).Errorf("*** data.Delete")
 					// Failed to delete but response is done and received.
 					// So it does not override status code.
@@ -414,5 +775,10 @@ func run() {
 		if err := server.Shutdown(ctx); err != nil {
 			logger.Fatalf("*** Failed to Shutdown(): %v", err)
 		}
+		if quota != nil {
+			if err := quota.Flush(ctx, time.Now()); err != nil {
+				logger.Errorf("*** DailyQuota.Flush: %v", err)
+			}
+		}
 	}()
 }
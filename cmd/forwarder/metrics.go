@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	forward "github.com/tckz/personal-forward"
+)
+
+const metricsNamespace = "forwarder"
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Number of requests by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "End-to-end latency from receiving the request to responding.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"endpoint"})
+	metricReturnDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "return_duration_seconds",
+		Help:      "Latency from the consumer writing the response to the forwarder receiving it.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"endpoint"})
+	metricResponseChunks = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_chunks",
+		Help:      "Number of chunks of the response body.",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16, 32},
+	}, []string{"endpoint"})
+	metricCancelled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cancelled_total",
+		Help:      "Number of requests which are cancelled because the client has gone or timed out.",
+	}, []string{"endpoint"})
+	metricFirestoreErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "firestore_errors_total",
+		Help:      "Number of errors of Firestore operations.",
+	}, []string{"op"})
+	metricCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lookups_total",
+		Help:      "Number of cacheable requests by endpoint and result. HIT, MISS or REVALIDATED.",
+	}, []string{"endpoint", "result"})
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Number of error responses of the forwarder by endpoint and category.",
+	}, []string{"endpoint", "category"})
+	metricRegistryUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "endpoint_registry_up",
+		Help:      "1 while the endpoint registry is listened, 0 while it is retrying.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRequests,
+		metricRequestDuration,
+		metricReturnDuration,
+		metricResponseChunks,
+		metricCancelled,
+		metricFirestoreErrors,
+		metricCacheLookups,
+		metricErrors,
+		metricRegistryUp,
+	)
+}
+
+type contextKeyMetricsLabelMarker struct{}
+
+var contextKeyMetricsLabel = &contextKeyMetricsLabelMarker{}
+
+// setMetricsLabel sets the endpoint label of the request which is observed by NewMetricsMiddleware.
+func setMetricsLabel(ctx context.Context, endpoint string) {
+	if label, ok := ctx.Value(contextKeyMetricsLabel).(*string); ok {
+		*label = endpoint
+	}
+}
+
+// NewMetricsMiddleware creates middleware which counts requests and observes latency by endpoint.
+// The endpoint is labeled after NewEndpointMiddleware accepts the request,
+// so that arbitrary hosts or paths of rejected requests do not grow labels. They are labeled as "-".
+func NewMetricsMiddleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			endpoint := "-"
+			ctx := context.WithValue(r.Context(), contextKeyMetricsLabel, &endpoint)
+
+			ww := forward.NewResponseWriterWrapper(w)
+			h.ServeHTTP(ww, r.WithContext(ctx))
+
+			metricRequests.WithLabelValues(endpoint, strconv.Itoa(ww.StatusCode)).Inc()
+			metricRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		})
+	}
+}
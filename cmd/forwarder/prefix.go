@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// prefixRule binds the value to the path prefix.
+type prefixRule struct {
+	Prefix string
+	Value  string
+}
+
+type prefixRules []prefixRule
+
+// parsePrefixRules parses "prefix=value" separated by white spaces.
+// Rules are sorted by descending length of the prefix so that the longest prefix matches first.
+func parsePrefixRules(s string) (prefixRules, error) {
+	var rules prefixRules
+	for _, e := range strings.Fields(s) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			return nil, fmt.Errorf("rule must be '/prefix=value': %s", e)
+		}
+		rules = append(rules, prefixRule{
+			Prefix: kv[0],
+			Value:  kv[1],
+		})
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+
+	return rules, nil
+}
+
+// Match returns the rule which has the longest prefix of the path.
+// The prefix matches at the boundary of segments. "/api" matches "/api" and "/api/x", not "/apiary".
+// The path is cleaned, so that dot-segments and duplicated slashes do not escape the rule.
+func (r prefixRules) Match(p string) (prefixRule, bool) {
+	p = cleanPath(p)
+	for _, e := range r {
+		if hasPathPrefix(p, e.Prefix) {
+			return e, true
+		}
+	}
+	return prefixRule{}, false
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(p, prefix)
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// cleanPath is path.Clean which keeps the trailing slash.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// NewCanonicalPathMiddleware creates middleware which rejects the request whose path is not canonical with 400.
+// e.g. "/./api/x", "/foo/../api/x" and "//api/x".
+// The consumer cleans the path to build the upstream URL, so that such paths could escape rules by prefix.
+func NewCanonicalPathMiddleware(errorPages *ErrorResponder) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p := r.URL.Path; p != cleanPath(p) {
+				errorPages.Respond(w, r, http.StatusBadRequest, ErrorBadPath, fmt.Errorf("path is not canonical: %s", p))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
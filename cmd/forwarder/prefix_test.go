@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrefixRulesMatch(t *testing.T) {
+	rules, err := parsePrefixRules("/=root /api=api /github/=github")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/api", "api"},
+		{"/api/x", "api"},
+		{"/apiary", "root"},
+		{"/./api/x", "api"},
+		{"/foo/../api/x", "api"},
+		{"//api/x", "api"},
+		{"/api/../x", "root"},
+		{"/github/", "github"},
+		{"/github", "root"},
+		{"/github/hook", "github"},
+		{"/x/../github/hook", "github"},
+		{"/", "root"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			rule, ok := rules.Match(tc.path)
+			if !ok {
+				t.Fatalf("no rule matched")
+			}
+			if rule.Value != tc.want {
+				t.Errorf("got %s, want %s", rule.Value, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrefixRulesMatchNone(t *testing.T) {
+	rules, err := parsePrefixRules("/api=api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/", "/apiary", "/x/api"} {
+		if rule, ok := rules.Match(p); ok {
+			t.Errorf("%s: unexpected match %s", p, rule.Prefix)
+		}
+	}
+}
+
+func TestParsePrefixRulesError(t *testing.T) {
+	for _, s := range []string{"api=x", "/api", "=x"} {
+		if _, err := parsePrefixRules(s); err == nil {
+			t.Errorf("%s: error expected", s)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/a/b/", "/a/b/"},
+		{"/a/./b", "/a/b"},
+		{"/a/../b", "/b"},
+		{"//a", "/a"},
+		{"/a//b/", "/a/b/"},
+		{"/..", "/"},
+		{"/a/.", "/a"},
+	} {
+		if got := cleanPath(tc.path); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestCanonicalPathMiddleware(t *testing.T) {
+	errorPages, err := NewErrorResponder("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewCanonicalPathMiddleware(errorPages)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		uri  string
+		want int
+	}{
+		{"/api/x", http.StatusOK},
+		{"/api/x/", http.StatusOK},
+		{"/api/x?a=../b", http.StatusOK},
+		{"/./api/x", http.StatusBadRequest},
+		{"/foo/../api/x", http.StatusBadRequest},
+		{"//api/x", http.StatusBadRequest},
+		{"/%2e/api/x", http.StatusBadRequest},
+		{"/api/%2e%2e/x", http.StatusBadRequest},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			if w.Code != tc.want {
+				t.Errorf("got %d, want %d", w.Code, tc.want)
+			}
+			if tc.want == http.StatusBadRequest && w.Header().Get("X-Forward-Error") != ErrorBadPath {
+				t.Errorf("X-Forward-Error: %s", w.Header().Get("X-Forward-Error"))
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	forward "github.com/tckz/personal-forward"
+	"google.golang.org/grpc/codes"
+)
+
+// tokenBucket holds tokens which are refilled at the rate up to the burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits requests per key by token bucket.
+type RateLimiter struct {
+	// Rate is number of requests per second.
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Allow consumes a token of the key.
+// When no token is available, it returns false and the duration until a token is refilled.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes buckets which are already full, they are same as new one.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	fill := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > fill {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// DailyQuota limits number of requests per day in UTC.
+// The count is shared by all instances through quota/{yyyy-mm-dd} document of Firestore.
+// Each instance counts requests in memory and adds them to the document every FlushInterval,
+// so that the quota can be exceeded by the requests which instances counted within the interval.
+type DailyQuota struct {
+	Client *firestore.Client
+	Limit  int64
+	// FlushInterval is the interval to add the local count to the document and to read the shared count.
+	FlushInterval time.Duration
+	// FailOpen allows requests while the shared count is not synced in 3 times of FlushInterval.
+	// Otherwise such requests are rejected.
+	FailOpen bool
+
+	mu sync.Mutex
+	// day is the day of shared.
+	day string
+	// shared is the count of the document at the last sync.
+	shared int64
+	// pending is the count of each day which is not flushed yet.
+	pending map[string]int64
+	synced  time.Time
+}
+
+func NewDailyQuota(client *firestore.Client, limit int64, flushInterval time.Duration, failOpen bool) *DailyQuota {
+	return &DailyQuota{
+		Client:        client,
+		Limit:         limit,
+		FlushInterval: flushInterval,
+		FailOpen:      failOpen,
+		pending:       map[string]int64{},
+	}
+}
+
+// Allow counts up the request.
+// When the quota is exceeded, it returns false and the duration until next day.
+// When the shared count is stale, it returns an error and the request is allowed only if FailOpen.
+func (q *DailyQuota) Allow(now time.Time) (bool, time.Duration, error) {
+	now = now.UTC()
+	day := now.Format("2006-01-02")
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.day != day {
+		// Instances flush the count of the new day soon, so that the shared count is not considered stale.
+		q.day = day
+		q.shared = 0
+	}
+
+	if q.shared+q.pending[day] >= q.Limit {
+		y, m, d := now.Date()
+		return false, time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now), nil
+	}
+
+	var err error
+	if now.Sub(q.synced) > q.FlushInterval*3 {
+		err = fmt.Errorf("daily quota is not synced since %s", q.synced.Format(time.RFC3339))
+		if !q.FailOpen {
+			return false, q.FlushInterval, err
+		}
+	}
+	q.pending[day]++
+	return true, 0, err
+}
+
+// Flush adds the local count to the documents and reads the shared count of today.
+func (q *DailyQuota) Flush(ctx context.Context, now time.Time) error {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = map[string]int64{}
+	q.mu.Unlock()
+
+	col := q.Client.Collection("quota")
+	var flushErr error
+	for day, n := range pending {
+		if _, err := col.Doc(day).Set(ctx, map[string]interface{}{
+			"count": firestore.Increment(n),
+		}, firestore.MergeAll); err != nil {
+			// Retry at the next flush.
+			q.mu.Lock()
+			q.pending[day] += n
+			q.mu.Unlock()
+			flushErr = errors.Wrapf(err, "*** Set: quota/%s", day)
+		}
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	var count int64
+	doc, err := col.Doc(day).Get(ctx)
+	if err != nil {
+		if s, ok := err.(forward.GRPCStatusHolder); !ok || s.GRPCStatus().Code() != codes.NotFound {
+			return errors.Wrapf(err, "*** Get: quota/%s", day)
+		}
+	} else {
+		count, _ = forward.AsInt64(doc.DataAt("count"))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Allow may have moved to the next day while reading.
+	if q.day <= day {
+		q.day = day
+		q.shared = count
+		q.synced = now
+	}
+	return nil
+}
+
+// Run flushes every FlushInterval until ctx is done.
+func (q *DailyQuota) Run(ctx context.Context) {
+	logger := forward.ExtractLogger(ctx).Sugar()
+	ticker := time.NewTicker(q.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.Flush(ctx, time.Now()); err != nil {
+				metricFirestoreErrors.WithLabelValues("quota").Inc()
+				logger.Errorf("*** DailyQuota.Flush: %v", err)
+			}
+		}
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, errorPages *ErrorResponder, retryAfter time.Duration, category string, reason string) {
+	sec := int64(math.Ceil(retryAfter.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	forward.ExtractLogger(r.Context()).Sugar().Warnf("Too many requests: %s, retryAfter=%d", reason, sec)
+	w.Header().Set("Retry-After", strconv.FormatInt(sec, 10))
+	errorPages.Respond(w, r, http.StatusTooManyRequests, category, fmt.Errorf("too many requests: %s", reason))
+}
+
+func quotaUnavailable(w http.ResponseWriter, r *http.Request, errorPages *ErrorResponder, retryAfter time.Duration, err error) {
+	sec := int64(math.Ceil(retryAfter.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(sec, 10))
+	errorPages.Respond(w, r, http.StatusServiceUnavailable, ErrorQuotaUnavailable, err)
+}
+
+// NewIPRateLimitMiddleware creates middleware which limits requests per client IP.
+func NewIPRateLimitMiddleware(limiter *RateLimiter, clientIP func(r *http.Request) net.IP, errorPages *ErrorResponder) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r).String()
+			if ok, retryAfter := limiter.Allow(ip, time.Now()); !ok {
+				tooManyRequests(w, r, errorPages, retryAfter, ErrorRateLimited, "ip="+ip)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewEndpointRateLimitMiddleware creates middleware which limits requests per endpoint and per day.
+// limiter or quota can be nil.
+func NewEndpointRateLimitMiddleware(limiter *RateLimiter, quota *DailyQuota, endpoint func(r *http.Request) string, errorPages *ErrorResponder) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			if limiter != nil {
+				ep := endpoint(r)
+				if ok, retryAfter := limiter.Allow(ep, now); !ok {
+					tooManyRequests(w, r, errorPages, retryAfter, ErrorRateLimited, "endpoint="+ep)
+					return
+				}
+			}
+			if quota != nil {
+				ok, retryAfter, err := quota.Allow(now)
+				if err != nil {
+					forward.ExtractLogger(r.Context()).Sugar().Errorf("*** DailyQuota.Allow: %v", err)
+				}
+				if !ok {
+					if err != nil {
+						quotaUnavailable(w, r, errorPages, retryAfter, err)
+					} else {
+						tooManyRequests(w, r, errorPages, retryAfter, ErrorQuotaExceeded, "daily quota")
+					}
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name  string
+		rate  float64
+		burst int
+		// offsets of requests from base
+		at   []time.Duration
+		want []bool
+	}{
+		{
+			name:  "burst",
+			rate:  1,
+			burst: 3,
+			at:    []time.Duration{0, 0, 0, 0},
+			want:  []bool{true, true, true, false},
+		},
+		{
+			name:  "refill",
+			rate:  1,
+			burst: 1,
+			at:    []time.Duration{0, 0, time.Millisecond * 500, time.Second},
+			want:  []bool{true, false, false, true},
+		},
+		{
+			name:  "refill up to burst",
+			rate:  10,
+			burst: 2,
+			at:    []time.Duration{0, 0, time.Hour, time.Hour, time.Hour},
+			want:  []bool{true, true, true, true, false},
+		},
+		{
+			name:  "burst at least 1",
+			rate:  1,
+			burst: 0,
+			at:    []time.Duration{0, 0},
+			want:  []bool{true, false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewRateLimiter(tc.rate, tc.burst)
+			for i, e := range tc.at {
+				if got, _ := l.Allow("k", base.Add(e)); got != tc.want[i] {
+					t.Errorf("#%d: got %t, want %t", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(2, 1)
+	l.Allow("k", now)
+	ok, retryAfter := l.Allow("k", now.Add(time.Millisecond*100))
+	if ok {
+		t.Fatalf("must not be allowed")
+	}
+	if retryAfter != time.Millisecond*400 {
+		t.Errorf("retryAfter=%s", retryAfter)
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(1, 1)
+	if ok, _ := l.Allow("a", now); !ok {
+		t.Errorf("a must be allowed")
+	}
+	if ok, _ := l.Allow("b", now); !ok {
+		t.Errorf("b must be allowed")
+	}
+	if ok, _ := l.Allow("a", now); ok {
+		t.Errorf("a must not be allowed")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(1, 5)
+	l.Allow("a", now)
+	l.Allow("b", now.Add(time.Minute))
+	l.Allow("c", now.Add(time.Minute*2))
+	// a and b are full before c.
+	if len(l.buckets) != 1 {
+		t.Errorf("buckets=%d", len(l.buckets))
+	}
+}
+
+func TestDailyQuotaAllow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		shared   int64
+		synced   time.Time
+		failOpen bool
+		wantOK   bool
+		wantErr  bool
+		// retryAfter of rejected request
+		wantRetry time.Duration
+	}{
+		{"under", 8, now, false, true, false, 0},
+		{"exceeded", 10, now, false, false, false, time.Hour},
+		{"stale", 0, now.Add(-time.Minute), false, false, true, time.Second * 5},
+		{"stale fail open", 0, now.Add(-time.Minute), true, true, true, 0},
+		{"exceeded while stale", 10, now.Add(-time.Minute), true, false, false, time.Hour},
+		{"not synced yet", 0, time.Time{}, false, false, true, time.Second * 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewDailyQuota(nil, 10, time.Second*5, tc.failOpen)
+			q.day = "2020-01-01"
+			q.shared = tc.shared
+			q.synced = tc.synced
+
+			ok, retryAfter, err := q.Allow(now)
+			if ok != tc.wantOK || (err != nil) != tc.wantErr {
+				t.Fatalf("ok=%t, err=%v", ok, err)
+			}
+			if retryAfter != tc.wantRetry {
+				t.Errorf("retryAfter=%s", retryAfter)
+			}
+			want := int64(0)
+			if ok {
+				want = 1
+			}
+			if q.pending["2020-01-01"] != want {
+				t.Errorf("pending=%d", q.pending["2020-01-01"])
+			}
+		})
+	}
+}
+
+func TestDailyQuotaAllowCountsLocally(t *testing.T) {
+	now := time.Date(2020, 1, 1, 23, 59, 59, 0, time.UTC)
+	q := NewDailyQuota(nil, 3, time.Second*5, false)
+	q.day = "2020-01-01"
+	q.shared = 1
+	q.synced = now
+
+	for i, want := range []bool{true, true, false} {
+		if ok, _, _ := q.Allow(now); ok != want {
+			t.Errorf("#%d: got %t", i, ok)
+		}
+	}
+
+	// The count of the next day starts from 0.
+	next := now.Add(time.Second * 2)
+	if ok, _, err := q.Allow(next); !ok || err != nil {
+		t.Errorf("next day: ok=%t, err=%v", ok, err)
+	}
+	if q.pending["2020-01-01"] != 2 || q.pending["2020-01-02"] != 1 {
+		t.Errorf("pending=%v", q.pending)
+	}
+}
+
+func TestEndpointRateLimitMiddlewareQuota(t *testing.T) {
+	errorPages, err := NewErrorResponder("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		shared    int64
+		synced    time.Time
+		want      int
+		wantError string
+	}{
+		{"allowed", 0, time.Now(), http.StatusOK, ""},
+		{"exceeded", 10, time.Now(), http.StatusTooManyRequests, ErrorQuotaExceeded},
+		{"unavailable", 0, time.Time{}, http.StatusServiceUnavailable, ErrorQuotaUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewDailyQuota(nil, 10, time.Second*5, false)
+			q.day = time.Now().UTC().Format("2006-01-02")
+			q.shared = tc.shared
+			q.synced = tc.synced
+			h := NewEndpointRateLimitMiddleware(nil, q, func(r *http.Request) string {
+				return "ep"
+			}, errorPages)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tc.want {
+				t.Errorf("got %d, want %d", w.Code, tc.want)
+			}
+			if got := w.Header().Get("X-Forward-Error"); got != tc.wantError {
+				t.Errorf("X-Forward-Error: %s", got)
+			}
+			if tc.wantError != "" && w.Header().Get("Retry-After") == "" {
+				t.Errorf("Retry-After is missing")
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	forward "github.com/tckz/personal-forward"
+)
+
+// SignatureVerifier verifies the signature of webhook request.
+type SignatureVerifier interface {
+	Verify(header http.Header, body []byte) error
+}
+
+// NewSignatureVerifier creates SignatureVerifier from spec.
+//
+//	github:secret            X-Hub-Signature-256
+//	stripe:secret            Stripe-Signature
+//	slack:secret             X-Slack-Signature, X-Slack-Request-Timestamp
+//	hmac:Header-Name:secret  HMAC-SHA256 of body in hex or base64
+func NewSignatureVerifier(spec string, tolerance time.Duration) (SignatureVerifier, error) {
+	kv := strings.SplitN(spec, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return nil, fmt.Errorf("signature spec must be 'kind:secret': %s", spec)
+	}
+
+	switch kv[0] {
+	case "github":
+		return &GitHubVerifier{Secret: []byte(kv[1])}, nil
+	case "stripe":
+		return &StripeVerifier{Secret: []byte(kv[1]), Tolerance: tolerance}, nil
+	case "slack":
+		return &SlackVerifier{Secret: []byte(kv[1]), Tolerance: tolerance}, nil
+	case "hmac":
+		hs := strings.SplitN(kv[1], ":", 2)
+		if len(hs) != 2 || hs[0] == "" || hs[1] == "" {
+			return nil, fmt.Errorf("hmac spec must be 'hmac:Header-Name:secret'")
+		}
+		return &HMACVerifier{Header: hs[0], Secret: []byte(hs[1])}, nil
+	}
+
+	return nil, fmt.Errorf("unknown signature kind: %s", kv[0])
+}
+
+func hmacSHA256(secret []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, e := range data {
+		mac.Write(e)
+	}
+	return mac.Sum(nil)
+}
+
+// checkTimestamp validates unix timestamp is within the tolerance.
+func checkTimestamp(ts string, tolerance time.Duration) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %s", ts)
+	}
+	if tolerance <= 0 {
+		return nil
+	}
+
+	d := time.Since(time.Unix(sec, 0))
+	if d < 0 {
+		d = -d
+	}
+	if d > tolerance {
+		return fmt.Errorf("timestamp out of tolerance: %s", ts)
+	}
+	return nil
+}
+
+// GitHubVerifier verifies X-Hub-Signature-256 of GitHub webhook.
+type GitHubVerifier struct {
+	Secret []byte
+}
+
+func (v *GitHubVerifier) Verify(header http.Header, body []byte) error {
+	sig := header.Get("X-Hub-Signature-256")
+	if !strings.HasPrefix(sig, "sha256=") {
+		return fmt.Errorf("X-Hub-Signature-256 is missing")
+	}
+
+	expected := hex.EncodeToString(hmacSHA256(v.Secret, body))
+	if !hmac.Equal([]byte(sig[len("sha256="):]), []byte(expected)) {
+		return fmt.Errorf("X-Hub-Signature-256 mismatch")
+	}
+	return nil
+}
+
+// StripeVerifier verifies Stripe-Signature of Stripe webhook.
+type StripeVerifier struct {
+	Secret    []byte
+	Tolerance time.Duration
+}
+
+func (v *StripeVerifier) Verify(header http.Header, body []byte) error {
+	sig := header.Get("Stripe-Signature")
+	if sig == "" {
+		return fmt.Errorf("Stripe-Signature is missing")
+	}
+
+	var ts string
+	var signatures []string
+	for _, e := range strings.Split(sig, ",") {
+		kv := strings.SplitN(strings.TrimSpace(e), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	if ts == "" || len(signatures) == 0 {
+		return fmt.Errorf("Stripe-Signature is malformed")
+	}
+	if err := checkTimestamp(ts, v.Tolerance); err != nil {
+		return err
+	}
+
+	expected := hex.EncodeToString(hmacSHA256(v.Secret, []byte(ts), []byte("."), body))
+	for _, e := range signatures {
+		if hmac.Equal([]byte(e), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Stripe-Signature mismatch")
+}
+
+// SlackVerifier verifies X-Slack-Signature of Slack request.
+type SlackVerifier struct {
+	Secret    []byte
+	Tolerance time.Duration
+}
+
+func (v *SlackVerifier) Verify(header http.Header, body []byte) error {
+	sig := header.Get("X-Slack-Signature")
+	ts := header.Get("X-Slack-Request-Timestamp")
+	if !strings.HasPrefix(sig, "v0=") || ts == "" {
+		return fmt.Errorf("X-Slack-Signature or X-Slack-Request-Timestamp is missing")
+	}
+	if err := checkTimestamp(ts, v.Tolerance); err != nil {
+		return err
+	}
+
+	expected := hex.EncodeToString(hmacSHA256(v.Secret, []byte("v0:"+ts+":"), body))
+	if !hmac.Equal([]byte(sig[len("v0="):]), []byte(expected)) {
+		return fmt.Errorf("X-Slack-Signature mismatch")
+	}
+	return nil
+}
+
+// HMACVerifier verifies HMAC-SHA256 of the body in the header.
+// The value is hex or base64 and "sha256=" prefix is allowed.
+type HMACVerifier struct {
+	Header string
+	Secret []byte
+}
+
+func (v *HMACVerifier) Verify(header http.Header, body []byte) error {
+	sig := strings.TrimPrefix(header.Get(v.Header), "sha256=")
+	if sig == "" {
+		return fmt.Errorf("%s is missing", v.Header)
+	}
+
+	mac := hmacSHA256(v.Secret, body)
+	if hmac.Equal([]byte(strings.ToLower(sig)), []byte(hex.EncodeToString(mac))) ||
+		hmac.Equal([]byte(sig), []byte(base64.StdEncoding.EncodeToString(mac))) {
+		return nil
+	}
+	return fmt.Errorf("%s mismatch", v.Header)
+}
+
+// NewSignatureMiddleware creates middleware which rejects the request with invalid signature.
+// rules are "prefix=spec" separated by white spaces. See NewSignatureVerifier for spec.
+func NewSignatureMiddleware(rules string, tolerance time.Duration, errorPages *ErrorResponder) (func(http.Handler) http.Handler, error) {
+	parsed, err := parsePrefixRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	verifiers := map[string]SignatureVerifier{}
+	for _, e := range parsed {
+		v, err := NewSignatureVerifier(e.Value, tolerance)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Prefix, err)
+		}
+		verifiers[e.Prefix] = v
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rule, ok := parsed.Match(r.URL.Path)
+			if !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			b, ok := readBody(w, r, errorPages)
+			if !ok {
+				return
+			}
+
+			if err := verifiers[rule.Prefix].Verify(r.Header, b); err != nil {
+				forward.ExtractLogger(r.Context()).Sugar().Warnf("Invalid signature: prefix=%s, %v", rule.Prefix, err)
+				errorPages.Respond(w, r, http.StatusUnauthorized, ErrorInvalidSignature, err)
+				return
+			}
+
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
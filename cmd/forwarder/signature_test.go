@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSignatureVerifier(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		ok   bool
+	}{
+		{"github:secret", true},
+		{"stripe:whsec_x", true},
+		{"slack:secret", true},
+		{"hmac:X-Signature:secret", true},
+		{"github:", false},
+		{"github", false},
+		{"hmac:secret", false},
+		{"hmac::secret", false},
+		{"unknown:secret", false},
+	} {
+		_, err := NewSignatureVerifier(tc.spec, time.Minute)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err=%v", tc.spec, err)
+		}
+	}
+}
+
+func TestGitHubVerifier(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+	valid := "sha256=" + hex.EncodeToString(hmacSHA256([]byte("secret"), body))
+	v := &GitHubVerifier{Secret: []byte("secret")}
+
+	for _, tc := range []struct {
+		name string
+		sig  string
+		body []byte
+		ok   bool
+	}{
+		{"valid", valid, body, true},
+		{"missing", "", body, false},
+		{"no prefix", valid[len("sha256="):], body, false},
+		{"other body", valid, []byte(`{}`), false},
+		{"other secret", "sha256=" + hex.EncodeToString(hmacSHA256([]byte("other"), body)), body, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.sig != "" {
+				h.Set("X-Hub-Signature-256", tc.sig)
+			}
+			if err := v.Verify(h, tc.body); (err == nil) != tc.ok {
+				t.Errorf("err=%v", err)
+			}
+		})
+	}
+}
+
+func TestStripeVerifier(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sign := func(ts string) string {
+		return hex.EncodeToString(hmacSHA256([]byte("whsec"), []byte(ts), []byte("."), body))
+	}
+	v := &StripeVerifier{Secret: []byte("whsec"), Tolerance: time.Minute * 5}
+
+	for _, tc := range []struct {
+		name string
+		sig  string
+		ok   bool
+	}{
+		{"valid", "t=" + now + ",v1=" + sign(now), true},
+		{"one of v1", "t=" + now + ",v1=deadbeef,v1=" + sign(now), true},
+		{"missing", "", false},
+		{"no timestamp", "v1=" + sign(now), false},
+		{"no v1", "t=" + now, false},
+		{"mismatch", "t=" + now + ",v1=" + sign(old), false},
+		{"out of tolerance", "t=" + old + ",v1=" + sign(old), false},
+		{"invalid timestamp", "t=x,v1=" + sign("x"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.sig != "" {
+				h.Set("Stripe-Signature", tc.sig)
+			}
+			if err := v.Verify(h, body); (err == nil) != tc.ok {
+				t.Errorf("err=%v", err)
+			}
+		})
+	}
+}
+
+func TestSlackVerifier(t *testing.T) {
+	body := []byte("token=x&command=/deploy")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sign := func(ts string) string {
+		return "v0=" + hex.EncodeToString(hmacSHA256([]byte("secret"), []byte("v0:"+ts+":"), body))
+	}
+	v := &SlackVerifier{Secret: []byte("secret"), Tolerance: time.Minute * 5}
+
+	for _, tc := range []struct {
+		name string
+		sig  string
+		ts   string
+		ok   bool
+	}{
+		{"valid", sign(now), now, true},
+		{"missing signature", "", now, false},
+		{"missing timestamp", sign(now), "", false},
+		{"timestamp mismatch", sign(old), now, false},
+		{"out of tolerance", sign(old), old, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.sig != "" {
+				h.Set("X-Slack-Signature", tc.sig)
+			}
+			if tc.ts != "" {
+				h.Set("X-Slack-Request-Timestamp", tc.ts)
+			}
+			if err := v.Verify(h, body); (err == nil) != tc.ok {
+				t.Errorf("err=%v", err)
+			}
+		})
+	}
+}
+
+func TestHMACVerifier(t *testing.T) {
+	body := []byte("payload")
+	mac := hmacSHA256([]byte("secret"), body)
+	v := &HMACVerifier{Header: "X-Signature", Secret: []byte("secret")}
+
+	for _, tc := range []struct {
+		name string
+		sig  string
+		ok   bool
+	}{
+		{"hex", hex.EncodeToString(mac), true},
+		{"upper hex", strings.ToUpper(hex.EncodeToString(mac)), true},
+		{"prefixed hex", "sha256=" + hex.EncodeToString(mac), true},
+		{"base64", base64.StdEncoding.EncodeToString(mac), true},
+		{"missing", "", false},
+		{"mismatch", hex.EncodeToString(hmacSHA256([]byte("other"), body)), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.sig != "" {
+				h.Set("X-Signature", tc.sig)
+			}
+			if err := v.Verify(h, body); (err == nil) != tc.ok {
+				t.Errorf("err=%v", err)
+			}
+		})
+	}
+}
+
+func TestSignatureMiddleware(t *testing.T) {
+	errorPages, err := NewErrorResponder("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, err := NewSignatureMiddleware("/hooks/github=github:secret", time.Minute, errorPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	body := `{"zen":"x"}`
+	valid := "sha256=" + hex.EncodeToString(hmacSHA256([]byte("secret"), []byte(body)))
+	for _, tc := range []struct {
+		uri  string
+		sig  string
+		want int
+	}{
+		{"/hooks/github", valid, http.StatusOK},
+		{"/hooks/github", "", http.StatusUnauthorized},
+		{"/hooks/github/x", "", http.StatusUnauthorized},
+		// Dot-segments and duplicated slashes must not skip the verification.
+		{"/./hooks/github", "", http.StatusUnauthorized},
+		{"/x/../hooks/github", "", http.StatusUnauthorized},
+		{"//hooks/github", "", http.StatusUnauthorized},
+		{"/hooks/githubx", "", http.StatusOK},
+		{"/other", "", http.StatusOK},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tc.uri, strings.NewReader(body))
+			if tc.sig != "" {
+				r.Header.Set("X-Hub-Signature-256", tc.sig)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
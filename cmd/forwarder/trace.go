@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// cloudTraceID returns the trace ID of X-Cloud-Trace-Context "TRACE_ID/SPAN_ID;o=TRACE_TRUE".
+// The frontend of GAE sets it and records the request log with the trace,
+// so that the logs of the forwarder are grouped under the request log.
+// It returns empty when the header is missing or malformed.
+func cloudTraceID(header http.Header) string {
+	v := header.Get("X-Cloud-Trace-Context")
+	if i := strings.IndexAny(v, "/;"); i >= 0 {
+		v = v[:i]
+	}
+	if len(v) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(v); err != nil {
+		return ""
+	}
+	return strings.ToLower(v)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCloudTraceID(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  string
+	}{
+		{"105445aa7843bc8bf206b12000100000/1;o=1", "105445aa7843bc8bf206b12000100000"},
+		{"105445AA7843BC8BF206B12000100000/1", "105445aa7843bc8bf206b12000100000"},
+		{"105445aa7843bc8bf206b12000100000;o=0", "105445aa7843bc8bf206b12000100000"},
+		{"105445aa7843bc8bf206b12000100000", "105445aa7843bc8bf206b12000100000"},
+		{"", ""},
+		{"105445aa/1;o=1", ""},
+		{"zz5445aa7843bc8bf206b12000100000/1;o=1", ""},
+	} {
+		h := http.Header{}
+		if tc.value != "" {
+			h.Set("X-Cloud-Trace-Context", tc.value)
+		}
+		if got := cloudTraceID(h); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.value, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// ValidateEncoding checks the encoding is supported. Empty means no compression.
+func ValidateEncoding(encoding string) error {
+	switch encoding {
+	case "", EncodingGzip, EncodingZstd:
+		return nil
+	}
+	return fmt.Errorf("unsupported encoding: %s", encoding)
+}
+
+// Compress compresses b with the encoding.
+func Compress(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(b); err != nil {
+			return nil, errors.Wrapf(err, "*** gzip.Write")
+		}
+		if err := zw.Close(); err != nil {
+			return nil, errors.Wrapf(err, "*** gzip.Close")
+		}
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		zw, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** zstd.NewWriter")
+		}
+		defer zw.Close()
+		return zw.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+}
+
+// Decompress decompresses b with the encoding. Empty encoding returns b as is.
+func Decompress(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return b, nil
+	case EncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** gzip.NewReader")
+		}
+		defer zr.Close()
+		ret, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** gzip.Read")
+		}
+		return ret, nil
+	case EncodingZstd:
+		zr, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** zstd.NewReader")
+		}
+		defer zr.Close()
+		ret, err := zr.DecodeAll(b, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** zstd.DecodeAll")
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+}
+
+// compressBody compresses body when it is not smaller than minBytes and compression makes it smaller.
+// It returns the body and its encoding.
+func compressBody(encoding string, minBytes int, body []byte) ([]byte, string, error) {
+	if encoding == "" || len(body) < minBytes {
+		return body, "", nil
+	}
+	b, err := Compress(encoding, body)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(b) >= len(body) {
+		return body, "", nil
+	}
+	return b, encoding, nil
+}
@@ -0,0 +1,118 @@
+package forward
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		encoding string
+		ok       bool
+	}{
+		{"", true},
+		{EncodingGzip, true},
+		{EncodingZstd, true},
+		{"br", false},
+		{"GZIP", false},
+	} {
+		if err := ValidateEncoding(tc.encoding); (err == nil) != tc.ok {
+			t.Errorf("%q: err=%v", tc.encoding, err)
+		}
+	}
+}
+
+func TestCompressDecompress(t *testing.T) {
+	body := []byte(strings.Repeat("hello ", 100))
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			b, err := Compress(encoding, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) >= len(body) {
+				t.Errorf("not compressed: %d", len(b))
+			}
+			got, err := Decompress(encoding, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("round trip mismatch")
+			}
+
+			if _, err := Decompress(encoding, []byte("garbage")); err == nil {
+				t.Errorf("broken data must fail")
+			}
+		})
+	}
+
+	if _, err := Compress("br", body); err == nil {
+		t.Errorf("unsupported encoding must fail")
+	}
+	if _, err := Decompress("br", body); err == nil {
+		t.Errorf("unsupported encoding must fail")
+	}
+	if got, err := Decompress("", body); err != nil || !bytes.Equal(got, body) {
+		t.Errorf("empty encoding must return as is")
+	}
+}
+
+func TestPayloadCompress(t *testing.T) {
+	large := []byte(strings.Repeat("hello ", 100))
+	// Random-looking bytes which get larger by compression.
+	incompressible := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		minBytes int
+		body     []byte
+		already  string
+		want     string
+	}{
+		{"gzip", EncodingGzip, 10, large, "", EncodingGzip},
+		{"zstd", EncodingZstd, 10, large, "", EncodingZstd},
+		{"disabled", "", 10, large, "", ""},
+		{"small", EncodingGzip, len(large) + 1, large, "", ""},
+		{"min bytes inclusive", EncodingGzip, len(large), large, "", EncodingGzip},
+		{"not effective", EncodingGzip, 0, incompressible, "", ""},
+		{"empty", EncodingGzip, 0, nil, "", ""},
+		// Compressed body is not compressed again.
+		{"already", EncodingZstd, 0, large, EncodingGzip, EncodingGzip},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &RequestPayload{Body: tc.body, Encoding: tc.already}
+			if err := req.Compress(tc.encoding, tc.minBytes); err != nil {
+				t.Fatal(err)
+			}
+			res := &ResponsePayload{Body: tc.body, Encoding: tc.already}
+			if err := res.Compress(tc.encoding, tc.minBytes); err != nil {
+				t.Fatal(err)
+			}
+			if req.Encoding != tc.want || res.Encoding != tc.want {
+				t.Fatalf("encoding=%q/%q, want %q", req.Encoding, res.Encoding, tc.want)
+			}
+			if tc.want == "" && (!bytes.Equal(req.Body, tc.body) || !bytes.Equal(res.Body, tc.body)) {
+				t.Errorf("body must not be changed")
+			}
+			if tc.already != "" {
+				return
+			}
+
+			if err := req.Decompress(); err != nil {
+				t.Fatal(err)
+			}
+			if err := res.Decompress(); err != nil {
+				t.Fatal(err)
+			}
+			if req.Encoding != "" || res.Encoding != "" {
+				t.Errorf("encoding must be cleared")
+			}
+			if !bytes.Equal(req.Body, tc.body) || !bytes.Equal(res.Body, tc.body) {
+				t.Errorf("round trip mismatch")
+			}
+		})
+	}
+}
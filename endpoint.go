@@ -0,0 +1,85 @@
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+)
+
+// Endpoint is the registered endpoint which is stored as the document of "endpoints" collection.
+type Endpoint struct {
+	Name    string    `firestore:"-"`
+	Owner   string    `firestore:"owner"`
+	Hosts   []string  `firestore:"hosts"`
+	Created time.Time `firestore:"created"`
+	Enabled bool      `firestore:"enabled"`
+	// APIKeyHash is hex of SHA-256 of the API key of the consumer.
+	APIKeyHash string `firestore:"apiKeyHash"`
+}
+
+// GenerateAPIKey creates random API key for the consumer.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrapf(err, "*** rand.Read")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashAPIKey returns the hash of API key which is stored in Firestore.
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// RegisterEndpoint creates the document of the endpoint. It fails when the endpoint already exists.
+func RegisterEndpoint(ctx context.Context, client *firestore.Client, ep *Endpoint) error {
+	if _, err := client.Collection("endpoints").Doc(ep.Name).Create(ctx, ep); err != nil {
+		if s, ok := err.(GRPCStatusHolder); ok && s.GRPCStatus().Code() == codes.AlreadyExists {
+			return fmt.Errorf("endpoint %s already exists", ep.Name)
+		}
+		return errors.Wrapf(err, "*** Create: %s", ep.Name)
+	}
+	return nil
+}
+
+// VerifyEndpoint checks the endpoint is enabled and available for the consumer which has the API key.
+// allowUnregistered accepts the endpoint which is not registered or has no API key, as older versions did.
+// The check is advisory. Access to Firestore must be restricted by IAM.
+func VerifyEndpoint(ctx context.Context, client *firestore.Client, name string, key string, allowUnregistered bool) error {
+	doc, err := client.Collection("endpoints").Doc(name).Get(ctx)
+	if err != nil {
+		if s, ok := err.(GRPCStatusHolder); ok && s.GRPCStatus().Code() == codes.NotFound {
+			if allowUnregistered {
+				return nil
+			}
+			return fmt.Errorf("endpoint %s is not registered", name)
+		}
+		return errors.Wrapf(err, "*** Get: %s", name)
+	}
+
+	if enabled, _ := doc.DataAt("enabled"); enabled != true {
+		return fmt.Errorf("endpoint %s is disabled", name)
+	}
+
+	hash, _ := AsString(doc.DataAt("apiKeyHash"))
+	if hash == "" {
+		if allowUnregistered {
+			return nil
+		}
+		return fmt.Errorf("endpoint %s has no API key", name)
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(HashAPIKey(key))) != 1 {
+		return fmt.Errorf("API key of endpoint %s is invalid", name)
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package forward
 
 import (
 	"fmt"
+	"strconv"
+	"sync/atomic"
 )
 
 type StringArrayFlag []string
@@ -14,3 +16,47 @@ func (f *StringArrayFlag) Set(value string) error {
 	*f = append(*f, value)
 	return nil
 }
+
+// SwitchFlag is the bool flag which can be toggled safely while running.
+type SwitchFlag struct {
+	v int32
+}
+
+func (f *SwitchFlag) String() string {
+	return strconv.FormatBool(f.Enabled())
+}
+
+func (f *SwitchFlag) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	f.SetEnabled(b)
+	return nil
+}
+
+func (f *SwitchFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *SwitchFlag) Enabled() bool {
+	return atomic.LoadInt32(&f.v) != 0
+}
+
+func (f *SwitchFlag) SetEnabled(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&f.v, v)
+}
+
+// Toggle flips the flag and returns the new value.
+func (f *SwitchFlag) Toggle() bool {
+	for {
+		old := atomic.LoadInt32(&f.v)
+		if atomic.CompareAndSwapInt32(&f.v, old, 1-old) {
+			return old == 0
+		}
+	}
+}
@@ -6,20 +6,25 @@ require (
 	cloud.google.com/go v0.50.0
 	cloud.google.com/go/firestore v1.1.1
 	cloud.google.com/go/storage v1.5.0 // indirect
-	contrib.go.opencensus.io/exporter/stackdriver v0.12.9
 	firebase.google.com/go v3.12.0+incompatible
 	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
 	github.com/alicebob/miniredis v2.5.0+incompatible
+	github.com/andybalholm/brotli v1.0.0
 	github.com/deckarep/golang-set v1.7.1
 	github.com/go-redis/redis v6.15.7+incompatible
 	github.com/gomodule/redigo v2.0.0+incompatible // indirect
 	github.com/joho/godotenv v1.3.0
+	github.com/klauspost/compress v1.10.3
 	github.com/pkg/errors v0.8.1
-	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb // indirect
-	go.opencensus.io v0.22.2
+	github.com/prometheus/client_golang v1.5.1
+	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb
+	go.opencensus.io v0.22.2 // indirect
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
 	go.uber.org/zap v1.13.0
 	goji.io v2.0.2+incompatible
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
 	google.golang.org/api v0.15.0
-	google.golang.org/grpc v1.26.0
+	google.golang.org/grpc v1.27.1
 )
@@ -0,0 +1,74 @@
+package forward
+
+import (
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+)
+
+const (
+	HoldActionRelease = "release"
+	HoldActionReject  = "reject"
+)
+
+// HoldDecision is the decision for the request which is held by the consumer.
+// It is written to "decision" field of the request document by forwardctl.
+type HoldDecision struct {
+	// Action is "release" or "reject".
+	Action string
+	// Request replaces the held request on release when it is not nil.
+	// It is written to "request" field of the document, not to the decision,
+	// so that the document does not hold the request twice.
+	Request *RequestPayload `json:"-"`
+	// Edited means "request" field of the document has been replaced on release.
+	Edited bool `json:",omitempty"`
+	// StatusCode and Message are the response on reject.
+	StatusCode int    `json:",omitempty"`
+	Message    string `json:",omitempty"`
+}
+
+// EncodeDecision converts the decision to the value of "decision" field of the document.
+// When d.Request is not nil, it must be written to "request" field with EncodeRequest at the same time.
+// When kr is not nil, the decision is encrypted.
+func EncodeDecision(id string, d *HoldDecision, kr *Keyring) (map[string]interface{}, error) {
+	d.Edited = d.Request != nil
+	if kr != nil {
+		return seal(kr, d, id+"/decision")
+	}
+
+	return map[string]interface{}{
+		"action":     d.Action,
+		"statusCode": d.StatusCode,
+		"message":    d.Message,
+		"edited":     d.Edited,
+	}, nil
+}
+
+// DecodeDecision extracts the decision from the document. It returns nil when the document has no decision.
+func DecodeDecision(doc *firestore.DocumentSnapshot, kr *Keyring) (*HoldDecision, error) {
+	if v, _ := doc.DataAt("decision"); v == nil {
+		return nil, nil
+	}
+
+	d := &HoldDecision{}
+	if sealed, err := open(kr, doc, "decision", doc.Ref.ID+"/decision", d); sealed {
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		d.Action, _ = AsString(doc.DataAt("decision.action"))
+		code, _ := AsInt64(doc.DataAt("decision.statusCode"))
+		d.StatusCode = int(code)
+		d.Message, _ = AsString(doc.DataAt("decision.message"))
+		v, _ := doc.DataAt("decision.edited")
+		d.Edited, _ = v.(bool)
+	}
+
+	if d.Edited {
+		req, err := DecodeRequest(doc, kr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** DecodeRequest")
+		}
+		d.Request = req
+	}
+	return d, nil
+}
@@ -0,0 +1,124 @@
+package forward
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Keyring holds AES-256-GCM keys to encrypt payloads in Firestore.
+type Keyring struct {
+	// CurrentID is ID of the key which is used to encrypt.
+	// Other keys are used only to decrypt, so that keys can be rotated.
+	CurrentID string
+
+	aeads map[string]cipher.AEAD
+}
+
+// LoadKeyring parses keys.
+// spec is "id:base64key" separated by white spaces or commas, or "@/path/to/file" which contains them one per line.
+// The first key is used to encrypt. Key must be 32 bytes.
+func LoadKeyring(spec string) (*Keyring, error) {
+	if strings.HasPrefix(spec, "@") {
+		b, err := readKeyFile(spec[1:])
+		if err != nil {
+			return nil, err
+		}
+		spec = b
+	}
+
+	kr := &Keyring{
+		aeads: map[string]cipher.AEAD{},
+	}
+	for _, e := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		kv := strings.SplitN(e, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("key must be 'id:base64key'")
+		}
+		key, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** key %s", kv[0])
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes", kv[0])
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** aes.NewCipher: %s", kv[0])
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** cipher.NewGCM: %s", kv[0])
+		}
+
+		if kr.CurrentID == "" {
+			kr.CurrentID = kv[0]
+		}
+		kr.aeads[kv[0]] = aead
+	}
+
+	if kr.CurrentID == "" {
+		return nil, fmt.Errorf("no key")
+	}
+	return kr, nil
+}
+
+func readKeyFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "*** Open: %s", file)
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return "", errors.Wrapf(err, "*** Scan: %s", file)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Seal encrypts plaintext with the current key.
+// aad binds the ciphertext to where it is stored.
+func (k *Keyring) Seal(plaintext, aad []byte) (keyID string, sealed []byte, err error) {
+	aead := k.aeads[k.CurrentID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, errors.Wrapf(err, "*** nonce")
+	}
+	return k.CurrentID, aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Open decrypts sealed by the key of keyID.
+func (k *Keyring) Open(keyID string, sealed, aad []byte) ([]byte, error) {
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", keyID)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed payload too short")
+	}
+	n := aead.NonceSize()
+	b, err := aead.Open(nil, sealed[:n], sealed[n:], aad)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** Open: key=%s", keyID)
+	}
+	return b, nil
+}
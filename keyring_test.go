@@ -0,0 +1,119 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(c byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{c}, 32))
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(file, []byte("# current\nk2:"+testKey(2)+"\n\nk1:"+testKey(1)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		spec    string
+		ok      bool
+		current string
+	}{
+		{"k1:" + testKey(1), true, "k1"},
+		{"k2:" + testKey(2) + ",k1:" + testKey(1), true, "k2"},
+		{"k2:" + testKey(2) + " k1:" + testKey(1), true, "k2"},
+		{"@" + file, true, "k2"},
+		{"@" + filepath.Join(dir, "none"), false, ""},
+		{"", false, ""},
+		{"k1", false, ""},
+		{":" + testKey(1), false, ""},
+		{"k1:!!!", false, ""},
+		{"k1:" + base64.StdEncoding.EncodeToString([]byte("short")), false, ""},
+	} {
+		kr, err := LoadKeyring(tc.spec)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err=%v", tc.spec, err)
+			continue
+		}
+		if err == nil && kr.CurrentID != tc.current {
+			t.Errorf("%s: CurrentID=%s, want %s", tc.spec, kr.CurrentID, tc.current)
+		}
+	}
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	kr, err := LoadKeyring("k2:" + testKey(2) + ",k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := LoadKeyring("k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadKeyring("k2:" + testKey(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte("hello")
+	keyID, sealed, err := kr.Seal(plain, []byte("id/request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "k2" {
+		t.Errorf("keyID=%s", keyID)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Errorf("sealed must not contain plaintext")
+	}
+	_, sealed2, err := kr.Seal(plain, []byte("id/request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, sealed2) {
+		t.Errorf("nonce must differ for each seal")
+	}
+
+	oldID, oldSealed, err := old.Seal(plain, []byte("id/request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		kr     *Keyring
+		keyID  string
+		sealed []byte
+		aad    string
+		ok     bool
+	}{
+		{"ok", kr, keyID, sealed, "id/request", true},
+		// The rotated key is still used to decrypt.
+		{"rotated", kr, oldID, oldSealed, "id/request", true},
+		{"unknown key", old, keyID, sealed, "id/request", false},
+		{"wrong key", other, keyID, sealed, "id/request", false},
+		{"wrong aad", kr, keyID, sealed, "other/request", false},
+		{"tampered", kr, keyID, append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1), "id/request", false},
+		{"too short", kr, keyID, sealed[:4], "id/request", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.kr.Open(tc.keyID, tc.sealed, []byte(tc.aad))
+			if (err == nil) != tc.ok {
+				t.Fatalf("err=%v", err)
+			}
+			if err == nil && !bytes.Equal(b, plain) {
+				t.Errorf("got %q", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package forward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+)
+
+// RequestPayload is the http request which is relayed via Firestore.
+type RequestPayload struct {
+	Method     string
+	RequestURI string
+	Header     http.Header
+	Body       []byte
+	// Encoding is the compression of Body. Empty means not compressed.
+	Encoding string `json:",omitempty"`
+}
+
+// Compress compresses Body with the encoding when the body is not smaller than minBytes and compression is effective.
+func (p *RequestPayload) Compress(encoding string, minBytes int) error {
+	if p.Encoding != "" {
+		return nil
+	}
+	b, enc, err := compressBody(encoding, minBytes, p.Body)
+	if err != nil {
+		return err
+	}
+	p.Body, p.Encoding = b, enc
+	return nil
+}
+
+// Decompress restores compressed Body.
+func (p *RequestPayload) Decompress() error {
+	b, err := Decompress(p.Encoding, p.Body)
+	if err != nil {
+		return err
+	}
+	p.Body, p.Encoding = b, ""
+	return nil
+}
+
+// ResponsePayload is the http response which is relayed via Firestore.
+type ResponsePayload struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Chunks is number of docs of responseBodies when the body is split.
+	Chunks int
+	// Error is set when the consumer failed to forward the request.
+	Error string
+	// Encoding is the compression of the body including chunks. Empty means not compressed.
+	Encoding string `json:",omitempty"`
+}
+
+// Compress compresses Body with the encoding when the body is not smaller than minBytes and compression is effective.
+// It must be called before the body is split to chunks.
+func (p *ResponsePayload) Compress(encoding string, minBytes int) error {
+	if p.Encoding != "" {
+		return nil
+	}
+	b, enc, err := compressBody(encoding, minBytes, p.Body)
+	if err != nil {
+		return err
+	}
+	p.Body, p.Encoding = b, enc
+	return nil
+}
+
+// Decompress restores compressed Body.
+// It must be called after chunks are joined to Body.
+func (p *ResponsePayload) Decompress() error {
+	b, err := Decompress(p.Encoding, p.Body)
+	if err != nil {
+		return err
+	}
+	p.Body, p.Encoding = b, ""
+	return nil
+}
+
+// seal encrypts JSON of v.
+// aad binds the encrypted payload to the document and the field.
+func seal(kr *Keyring, v interface{}, aad string) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "*** json.Marshal")
+	}
+	keyID, sealed, err := kr.Seal(b, []byte(aad))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"keyId":  keyID,
+		"sealed": sealed,
+	}, nil
+}
+
+// open decrypts the field into v when the field is encrypted.
+// It returns false when the field is not encrypted.
+func open(kr *Keyring, doc *firestore.DocumentSnapshot, field string, aad string, v interface{}) (bool, error) {
+	keyID, _ := AsString(doc.DataAt(field + ".keyId"))
+	if keyID == "" {
+		return false, nil
+	}
+	if kr == nil {
+		return true, fmt.Errorf("%s is encrypted but no key is specified", field)
+	}
+
+	sealed, err := AsByte(doc.DataAt(field + ".sealed"))
+	if err != nil {
+		return true, errors.Wrapf(err, "*** %s.sealed", field)
+	}
+	b, err := kr.Open(keyID, sealed, []byte(aad))
+	if err != nil {
+		return true, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return true, errors.Wrapf(err, "*** json.Unmarshal: %s", field)
+	}
+	return true, nil
+}
+
+// sealWithBody encrypts v without the body as JSON, and the body as raw bytes in "sealedBody".
+// The body is not base64 encoded in JSON, so that the encrypted field is as large as the plain one except nonce and tag.
+func sealWithBody(kr *Keyring, v interface{}, body []byte, aad string) (map[string]interface{}, error) {
+	val, err := seal(kr, v, aad)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		_, sealed, err := kr.Seal(body, []byte(aad+"/body"))
+		if err != nil {
+			return nil, err
+		}
+		val["sealedBody"] = sealed
+	}
+	return val, nil
+}
+
+// openBody decrypts "sealedBody" of the encrypted field. It returns nil when the field has no sealed body.
+func openBody(kr *Keyring, doc *firestore.DocumentSnapshot, field string, aad string) ([]byte, error) {
+	sealed, err := AsByte(doc.DataAt(field + ".sealedBody"))
+	if err != nil || sealed == nil {
+		return nil, nil
+	}
+	keyID, _ := AsString(doc.DataAt(field + ".keyId"))
+	return kr.Open(keyID, sealed, []byte(aad+"/body"))
+}
+
+// EncodeRequest converts the request to the value of "request" field of the document.
+// When kr is not nil, the request is encrypted.
+func EncodeRequest(id string, req *RequestPayload, kr *Keyring) (map[string]interface{}, error) {
+	if kr != nil {
+		meta := *req
+		meta.Body = nil
+		return sealWithBody(kr, &meta, req.Body, id+"/request")
+	}
+
+	val := map[string]interface{}{
+		"httpInfo": map[string]interface{}{
+			"method":     req.Method,
+			"requestURI": req.RequestURI,
+		},
+		"header": req.Header,
+		"body":   req.Body,
+	}
+	if req.Encoding != "" {
+		val["encoding"] = req.Encoding
+	}
+	return val, nil
+}
+
+// DecodeRequest extracts the request from the document.
+func DecodeRequest(doc *firestore.DocumentSnapshot, kr *Keyring) (*RequestPayload, error) {
+	req := &RequestPayload{}
+	if sealed, err := open(kr, doc, "request", doc.Ref.ID+"/request", req); sealed {
+		if err != nil {
+			return req, err
+		}
+		body, err := openBody(kr, doc, "request", doc.Ref.ID+"/request")
+		if body != nil {
+			req.Body = body
+		}
+		return req, err
+	}
+
+	decodePlainRequest(doc, "request", req)
+	return req, nil
+}
+
+// decodePlainRequest extracts the request which is not encrypted from the field.
+func decodePlainRequest(doc *firestore.DocumentSnapshot, field string, req *RequestPayload) {
+	req.Method, _ = AsString(doc.DataAt(field + ".httpInfo.method"))
+	req.RequestURI, _ = AsString(doc.DataAt(field + ".httpInfo.requestURI"))
+	req.Header, _ = AsHeader(doc.DataAt(field + ".header"))
+	req.Body, _ = AsByte(doc.DataAt(field + ".body"))
+	req.Encoding, _ = AsString(doc.DataAt(field + ".encoding"))
+}
+
+// EncodeResponse converts the response to the value of "response" field of the document.
+// When kr is not nil, the response is encrypted.
+func EncodeResponse(id string, res *ResponsePayload, kr *Keyring) (map[string]interface{}, error) {
+	var val map[string]interface{}
+	if kr != nil {
+		// The body is in responseBodies when it is split to chunks.
+		meta := *res
+		meta.Body = nil
+		var body []byte
+		if res.Chunks == 0 {
+			body = res.Body
+		}
+		v, err := sealWithBody(kr, &meta, body, id+"/response")
+		if err != nil {
+			return nil, err
+		}
+		val = v
+	} else if res.Error != "" {
+		val = map[string]interface{}{
+			"error": res.Error,
+		}
+	} else {
+		val = map[string]interface{}{
+			"statusCode": res.StatusCode,
+			"header":     res.Header,
+			"chunks":     res.Chunks,
+		}
+		if res.Chunks == 0 {
+			val["body"] = res.Body
+		}
+		if res.Encoding != "" {
+			val["encoding"] = res.Encoding
+		}
+	}
+
+	val["time"] = firestore.ServerTimestamp
+	return val, nil
+}
+
+// DecodeResponse extracts the response from the document.
+func DecodeResponse(doc *firestore.DocumentSnapshot, kr *Keyring) (*ResponsePayload, error) {
+	res := &ResponsePayload{}
+	if sealed, err := open(kr, doc, "response", doc.Ref.ID+"/response", res); sealed {
+		if err != nil {
+			return res, err
+		}
+		body, err := openBody(kr, doc, "response", doc.Ref.ID+"/response")
+		if body != nil {
+			res.Body = body
+		}
+		return res, err
+	}
+
+	res.Error, _ = AsString(doc.DataAt("response.error"))
+	code, _ := AsInt64(doc.DataAt("response.statusCode"))
+	res.StatusCode = int(code)
+	res.Header, _ = AsHeader(doc.DataAt("response.header"))
+	res.Body, _ = AsByte(doc.DataAt("response.body"))
+	chunks, _ := AsInt64(doc.DataAt("response.chunks"))
+	res.Chunks = int(chunks)
+	res.Encoding, _ = AsString(doc.DataAt("response.encoding"))
+	return res, nil
+}
+
+func chunkAAD(id string, index int64) []byte {
+	return []byte(fmt.Sprintf("%s/responseBodies/%d", id, index))
+}
+
+// EncodeChunk converts the chunk of response body to the document of responseBodies.
+// id is ID of the parent document.
+func EncodeChunk(id string, index int, chunk []byte, kr *Keyring) (map[string]interface{}, error) {
+	val := map[string]interface{}{
+		"index": index,
+		"size":  len(chunk),
+	}
+
+	if kr != nil {
+		keyID, sealed, err := kr.Seal(chunk, chunkAAD(id, int64(index)))
+		if err != nil {
+			return nil, err
+		}
+		val["keyId"] = keyID
+		val["chunk"] = sealed
+	} else {
+		val["chunk"] = chunk
+	}
+
+	return val, nil
+}
+
+// DecodeChunk extracts the chunk of response body from the document of responseBodies.
+// id is ID of the parent document.
+func DecodeChunk(id string, doc *firestore.DocumentSnapshot, kr *Keyring) (int64, []byte, error) {
+	index, _ := AsInt64(doc.DataAt("index"))
+	chunk, _ := AsByte(doc.DataAt("chunk"))
+
+	keyID, _ := AsString(doc.DataAt("keyId"))
+	if keyID == "" {
+		return index, chunk, nil
+	}
+	if kr == nil {
+		return index, nil, fmt.Errorf("chunk is encrypted but no key is specified")
+	}
+
+	b, err := kr.Open(keyID, chunk, chunkAAD(id, index))
+	return index, b, err
+}
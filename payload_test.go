@@ -0,0 +1,142 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestEncodeRequestSealed(t *testing.T) {
+	kr, err := LoadKeyring("k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &RequestPayload{
+		Method:     "POST",
+		RequestURI: "/hooks/secret",
+		Header:     http.Header{"Authorization": {"Bearer token"}},
+		Body:       []byte("secret body"),
+	}
+
+	val, err := EncodeRequest("id1", req, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"httpInfo", "header", "body"} {
+		if _, ok := val[k]; ok {
+			t.Errorf("%s must not be stored in plain", k)
+		}
+	}
+
+	meta, err := kr.Open(val["keyId"].(string), val["sealed"].([]byte), []byte("id1/request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &RequestPayload{}
+	if err := json.Unmarshal(meta, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != req.Method || got.RequestURI != req.RequestURI || got.Header.Get("Authorization") != "Bearer token" || got.Body != nil {
+		t.Errorf("meta=%+v", got)
+	}
+
+	body, err := kr.Open(val["keyId"].(string), val["sealedBody"].([]byte), []byte("id1/request/body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, req.Body) {
+		t.Errorf("body=%q", body)
+	}
+
+	// The sealed payload can not be moved to another document or field.
+	for _, aad := range []string{"id2/request", "id1/response", "id1/request/body"} {
+		if _, err := kr.Open(val["keyId"].(string), val["sealed"].([]byte), []byte(aad)); err == nil {
+			t.Errorf("%s: must fail", aad)
+		}
+	}
+}
+
+func TestEncodeResponseSealed(t *testing.T) {
+	kr, err := LoadKeyring("k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		res      *ResponsePayload
+		wantBody bool
+	}{
+		{"body", &ResponsePayload{StatusCode: 200, Body: []byte("secret")}, true},
+		{"chunked", &ResponsePayload{StatusCode: 200, Body: []byte("secret"), Chunks: 2}, false},
+		{"empty", &ResponsePayload{StatusCode: 204}, false},
+		{"error", &ResponsePayload{Error: "failed"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			val, err := EncodeResponse("id1", tc.res, kr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{"statusCode", "header", "body", "error"} {
+				if _, ok := val[k]; ok {
+					t.Errorf("%s must not be stored in plain", k)
+				}
+			}
+			meta, err := kr.Open(val["keyId"].(string), val["sealed"].([]byte), []byte("id1/response"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &ResponsePayload{}
+			if err := json.Unmarshal(meta, got); err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != tc.res.StatusCode || got.Chunks != tc.res.Chunks || got.Error != tc.res.Error {
+				t.Errorf("meta=%+v", got)
+			}
+
+			sealedBody, ok := val["sealedBody"].([]byte)
+			if ok != tc.wantBody {
+				t.Fatalf("sealedBody=%v", ok)
+			}
+			if ok {
+				body, err := kr.Open(val["keyId"].(string), sealedBody, []byte("id1/response/body"))
+				if err != nil || !bytes.Equal(body, tc.res.Body) {
+					t.Errorf("body=%q, err=%v", body, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeChunkSealed(t *testing.T) {
+	kr, err := LoadKeyring("k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := []byte("chunk")
+
+	val, err := EncodeChunk("id1", 3, chunk, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(val["chunk"].([]byte), chunk) {
+		t.Errorf("chunk must be encrypted")
+	}
+	b, err := kr.Open(val["keyId"].(string), val["chunk"].([]byte), chunkAAD("id1", 3))
+	if err != nil || !bytes.Equal(b, chunk) {
+		t.Errorf("chunk=%q, err=%v", b, err)
+	}
+	// Chunks can not be reordered.
+	if _, err := kr.Open(val["keyId"].(string), val["chunk"].([]byte), chunkAAD("id1", 2)); err == nil {
+		t.Errorf("must fail with another index")
+	}
+
+	val, err = EncodeChunk("id1", 3, chunk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := val["keyId"]; ok || !bytes.Equal(val["chunk"].([]byte), chunk) {
+		t.Errorf("plain chunk=%v", val)
+	}
+}
@@ -0,0 +1,63 @@
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+
+	"cloud.google.com/go/firestore"
+)
+
+// RequestIDHeader is the header which carries the request ID from the client to the upstream and back.
+const RequestIDHeader = "X-Request-Id"
+
+const requestIDChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// NewRequestID generates the random ID. The format is same as auto IDs of Firestore.
+func NewRequestID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = requestIDChars[int(b[i])%len(requestIDChars)]
+	}
+	return string(b)
+}
+
+// ValidRequestID reports whether the ID from the client can be accepted.
+// It must be printable ASCII without spaces and up to 128 bytes.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDOf returns the request ID of the request document.
+// The document ID is used for the document which is written by the forwarder without the request ID.
+func RequestIDOf(doc *firestore.DocumentSnapshot) string {
+	if id, err := AsString(doc.DataAt("requestId")); err == nil && id != "" {
+		return id
+	}
+	return doc.Ref.ID
+}
+
+type contextKeyRequestIDMarker struct{}
+
+var contextKeyRequestID = &contextKeyRequestIDMarker{}
+
+// WithRequestID returns new context instance which holds the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKeyRequestID, id)
+}
+
+// ExtractRequestID retrieves the request ID from context. Empty when it is not set.
+func ExtractRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKeyRequestID).(string)
+	return id
+}
@@ -0,0 +1,170 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+)
+
+// Sweeper deletes documents which are left in Firestore.
+// e.g. requests which no consumer listens to, responses whose client has gone and chunks whose request was deleted.
+type Sweeper struct {
+	Client *firestore.Client
+	// Expire is the age of requests to be deleted.
+	Expire time.Duration
+	// DryRun only reports documents to be deleted.
+	DryRun bool
+}
+
+// SweepReport is the number of documents which are deleted by Sweep.
+type SweepReport struct {
+	// Requests is number of requests which have no response.
+	Requests int
+	// Responses is number of requests which have response but are not deleted by the forwarder.
+	Responses int
+	// Chunks is number of chunks including the chunks of deleted requests.
+	Chunks int
+	// OrphanedChunks is number of chunks whose request does not exist.
+	OrphanedChunks int
+	// Quotas is number of quota documents of the days before yesterday.
+	Quotas int
+}
+
+// Sweep deletes expired requests, orphaned chunks of all endpoints and old quota documents in batches.
+func (s *Sweeper) Sweep(ctx context.Context) (*SweepReport, error) {
+	endpoints, err := EndpointNames(ctx, s.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SweepReport{}
+	var refs []*firestore.DocumentRef
+	before := time.Now().Add(-s.Expire)
+	for _, ep := range endpoints {
+		docs, err := expiredRequests(ctx, s.Client, ep, before)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range docs {
+			if v, _ := e.DataAt("response"); v != nil {
+				report.Responses++
+			} else {
+				report.Requests++
+			}
+			r, err := requestRefs(ctx, e.Ref)
+			if err != nil {
+				return nil, err
+			}
+			report.Chunks += len(r) - 1
+			refs = append(refs, r...)
+		}
+	}
+
+	orphaned, err := OrphanedChunks(ctx, s.Client)
+	if err != nil {
+		return nil, err
+	}
+	report.OrphanedChunks = len(orphaned)
+	refs = append(refs, orphaned...)
+
+	// The count of yesterday is kept, since instances may flush it after the day changed.
+	quotas, err := ExpiredQuotas(ctx, s.Client, time.Now().AddDate(0, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	report.Quotas = len(quotas)
+	refs = append(refs, quotas...)
+
+	if s.DryRun {
+		return report, nil
+	}
+	if err := DeleteRefs(ctx, s.Client, refs); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Run sweeps periodically until ctx is done.
+// Only the instance which takes the lease of leases/sweeper document sweeps in each interval,
+// so that forwarders on many instances and consumers do not sweep at the same time.
+func (s *Sweeper) Run(ctx context.Context, interval time.Duration) {
+	logger := ExtractLogger(ctx).Sugar()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	holder := leaseHolder()
+	for {
+		func() {
+			until, acquired, err := s.acquireLease(ctx, holder, interval)
+			if err != nil {
+				logger.Errorf("*** Sweep lease: %v", err)
+				return
+			}
+			if !acquired {
+				logger.Debugf("Sweep is skipped, lease is held until %s", until.Format(time.RFC3339))
+				return
+			}
+
+			report, err := s.Sweep(ctx)
+			if err != nil {
+				logger.Errorf("*** Sweep: %v", err)
+				return
+			}
+			logger.Infof("Sweep: dryRun=%t, requests=%d, responses=%d, chunks=%d, orphanedChunks=%d, quotas=%d",
+				s.DryRun, report.Requests, report.Responses, report.Chunks, report.OrphanedChunks, report.Quotas)
+		}()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func leaseHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// acquireLease takes the lease of the sweeper for the duration unless another holder has it.
+// It returns the expiry of the lease held by another holder when it is not acquired.
+func (s *Sweeper) acquireLease(ctx context.Context, holder string, d time.Duration) (time.Time, bool, error) {
+	ref := s.Client.Collection("leases").Doc("sweeper")
+	var until time.Time
+	acquired := false
+	err := s.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		acquired = false
+		now := time.Now()
+		doc, err := tx.Get(ref)
+		if err != nil {
+			if st, ok := err.(GRPCStatusHolder); !ok || st.GRPCStatus().Code() != codes.NotFound {
+				return err
+			}
+		} else {
+			until, _ = AsTime(doc.DataAt("until"))
+			if h, _ := AsString(doc.DataAt("holder")); h != holder && until.After(now) {
+				return nil
+			}
+		}
+
+		acquired = true
+		// A little shorter than the interval, so that the holder can take it again at the next tick.
+		return tx.Set(ref, map[string]interface{}{
+			"holder": holder,
+			"until":  now.Add(d - d/10),
+		})
+	})
+	if err != nil {
+		return time.Time{}, false, errors.Wrapf(err, "*** RunTransaction: %s", ref.Path)
+	}
+	return until, acquired, nil
+}
@@ -1,5 +1,101 @@
 package forward
 
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/trace/stdout"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
 const (
-	CloudTraceContext = "X-Cloud-Trace-Context"
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+	TraceExporterNone   = "none"
 )
+
+const tracerName = "github.com/tckz/personal-forward"
+
+// Propagators propagates W3C Trace Context.
+// The context is stored in the header of the request document, so that one trace covers the forwarder and the consumer.
+var Propagators = propagation.New(
+	propagation.WithInjectors(trace.TraceContext{}),
+	propagation.WithExtractors(trace.TraceContext{}),
+)
+
+// Tracer returns the tracer of this module.
+func Tracer() trace.Tracer {
+	return global.Tracer(tracerName)
+}
+
+// InitTracer installs the trace provider which exports spans with the exporter.
+// exporter is "otlp", "stdout" or "none". otlpAddress is host:port of the collector.
+// It returns the func which flushes and stops the exporter.
+func InitTracer(exporter string, otlpAddress string, serviceName string) (func(), error) {
+	global.SetPropagators(Propagators)
+
+	var sp sdktrace.SpanProcessor
+	stop := func() {}
+	switch exporter {
+	case TraceExporterNone, "":
+		return stop, nil
+	case TraceExporterStdout:
+		exp, err := stdout.NewExporter(stdout.Options{Writer: os.Stderr})
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** stdout.NewExporter")
+		}
+		sp = sdktrace.NewSimpleSpanProcessor(exp)
+	case TraceExporterOTLP:
+		exp, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(otlpAddress))
+		if err != nil {
+			return nil, errors.Wrapf(err, "*** otlp.NewExporter")
+		}
+		stop = func() {
+			exp.Stop()
+		}
+		bsp, err := sdktrace.NewBatchSpanProcessor(exp)
+		if err != nil {
+			stop()
+			return nil, errors.Wrapf(err, "*** NewBatchSpanProcessor")
+		}
+		sp = bsp
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter: %s", exporter)
+	}
+
+	tp, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithResource(resource.New(standard.ServiceNameKey.String(serviceName))),
+	)
+	if err != nil {
+		stop()
+		return nil, errors.Wrapf(err, "*** sdktrace.NewProvider")
+	}
+	tp.RegisterSpanProcessor(sp)
+	global.SetTraceProvider(tp)
+
+	return func() {
+		// Unregistering flushes spans which are not exported yet.
+		tp.UnregisterSpanProcessor(sp)
+		stop()
+	}, nil
+}
+
+// InjectTraceContext writes the trace context of ctx to the header.
+func InjectTraceContext(ctx context.Context, header http.Header) {
+	propagation.InjectHTTP(ctx, Propagators, header)
+}
+
+// ExtractTraceContext returns ctx which has the remote trace context in the header.
+func ExtractTraceContext(ctx context.Context, header http.Header) context.Context {
+	return propagation.ExtractHTTP(ctx, Propagators, header)
+}